@@ -0,0 +1,178 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var errACLDenied = errors.New("denied by acl")
+
+// ACLAction is what a rule does to the matching addresses
+type ACLAction int
+
+const (
+	// ACLAllow allows the matching addresses
+	ACLAllow ACLAction = iota
+	// ACLDeny denies the matching addresses
+	ACLDeny
+)
+
+// ACLRule applies its action to the addresses matching its conditions
+type ACLRule struct {
+	// Action is applied to the matching addresses
+	Action ACLAction
+	Conditions
+}
+
+// ACL is the access control list of the target addresses, the first matching rule applies
+type ACL struct {
+	// Rules are tried in order
+	Rules []*ACLRule
+	// Default is the action when no rule matches
+	Default ACLAction
+	// Resolve resolves the domain names for the rules on networks,
+	// otherwise those rules never match a domain name
+	Resolve bool
+	// Resolver optionally specifies an alternate resolver to use
+	Resolver *net.Resolver
+}
+
+// DefaultACL returns an ACL denying the loopback, private, link-local and multicast networks,
+// and allowing everything else
+func DefaultACL() *ACL {
+	acl, _ := ParseACL(strings.NewReader(defaultACL))
+	return acl
+}
+
+const defaultACL = `
+resolve
+deny domain-suffix localhost
+deny cidr 0.0.0.0/8 10.0.0.0/8 100.64.0.0/10 127.0.0.0/8 169.254.0.0/16 172.16.0.0/12 192.168.0.0/16 224.0.0.0/4 240.0.0.0/4
+deny cidr ::/128 ::1/128 fc00::/7 fe80::/10 ff00::/8
+default allow
+`
+
+// LoadACL reads an ACL from the file, see ParseACL for its format,
+// the list files are relative to the directory of the file
+func LoadACL(file string) (*ACL, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	acl, err := parseACL(f, filepath.Dir(file))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return acl, nil
+}
+
+// ParseACL reads an ACL, one rule per line tried in order, such as
+//
+//	# comment
+//	deny cidr 10.0.0.0/8 192.168.0.0/16
+//	deny domain-suffix internal.example.com
+//	allow domain-keyword example domain-regex ^api\d+\. port 443 8000-8999
+//	deny cidr-file blocked_ips.txt
+//	deny port 25
+//	default allow
+//	resolve
+//
+// A rule is allow or deny followed by its conditions, "cidr", "domain-suffix", "domain-keyword",
+// "domain-regex" or "port" and their values, or "all" matching everything.
+// "cidr-file" and "domain-file" read the networks and the domain suffixes from list files, one per line.
+// "default" sets the action when no rule matches, "resolve" resolves the domain names for the cidr conditions.
+func ParseACL(r io.Reader) (*ACL, error) {
+	return parseACL(r, "")
+}
+
+func parseACL(r io.Reader, dir string) (*ACL, error) {
+	rs, err := parseRules(r, dir, parseACLAction)
+	if err != nil {
+		return nil, fmt.Errorf("acl %w", err)
+	}
+	acl := &ACL{
+		Default: ACLAction(rs.def),
+		Resolve: rs.resolve,
+	}
+	for _, r := range rs.rules {
+		acl.Rules = append(acl.Rules, &ACLRule{
+			Action:     ACLAction(r.action),
+			Conditions: r.conditions,
+		})
+	}
+	return acl, nil
+}
+
+func parseACLAction(s string) (int, error) {
+	switch s {
+	case "allow":
+		return int(ACLAllow), nil
+	case "deny":
+		return int(ACLDeny), nil
+	}
+	return 0, fmt.Errorf("unknown action %q", s)
+}
+
+// Check returns an error when the target address, host:port, is denied
+func (a *ACL) Check(ctx context.Context, target string) error {
+	addr, err := parseAddress(target)
+	if err != nil {
+		return err
+	}
+	_, err = a.check(ctx, addr)
+	return err
+}
+
+// check is Check on an address, a nil ACL allows everything.
+// It returns the address to connect to, when the domain name was resolved it is an allowed ip of the name,
+// so that the name can't resolve to another ip when connecting.
+func (a *ACL) check(ctx context.Context, target net.Addr) (*address, error) {
+	addr, err := toAddress(target)
+	if err != nil {
+		return nil, err
+	}
+	if a == nil {
+		return addr, nil
+	}
+	action, ips, err := a.action(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	if ips == nil {
+		if action == ACLDeny {
+			return nil, fmt.Errorf("%s: %w", addr, errACLDenied)
+		}
+		return addr, nil
+	}
+	for _, ip := range ips {
+		action, _, err = a.action(ctx, &address{Name: addr.Name, IP: ip, Port: addr.Port})
+		if err != nil {
+			return nil, err
+		}
+		if action == ACLAllow {
+			return &address{IP: ip, Port: addr.Port}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %w", addr, errACLDenied)
+}
+
+// action returns the action of the first matching rule, and the ips of the domain name if it was resolved
+func (a *ACL) action(ctx context.Context, addr *address) (ACLAction, []net.IP, error) {
+	i, ips, err := firstMatch(ctx, addr, len(a.Rules), func(i int) *Conditions {
+		return &a.Rules[i].Conditions
+	}, a.Resolve, a.Resolver)
+	if err != nil {
+		return 0, nil, fmt.Errorf("acl %s: %w", addr, err)
+	}
+	if i == -1 {
+		return a.Default, ips, nil
+	}
+	return a.Rules[i].Action, ips, nil
+}
@@ -16,7 +16,11 @@ var _zerononce [128]byte // read-only. 128 bytes is more than enough.
 
 func RegisterCipher(method string, keyLen int, cipher func(key []byte) (cipher.AEAD, error)) {
 	shadowsocks.RegisterCipher(method, func(password string) (shadowsocks.ConnCipher, error) {
-		return &Cipher{Rand: rand.Reader, Key: shadowsocks.KDF(password, keyLen), NewAEAD: cipher}, nil
+		c := &Cipher{Rand: rand.Reader, Key: shadowsocks.KDF(password, keyLen), NewAEAD: cipher}
+		if shadowsocks.NewSaltFilter != nil {
+			c.SaltFilter = shadowsocks.NewSaltFilter()
+		}
+		return c, nil
 	})
 }
 
@@ -29,12 +33,19 @@ type Cipher struct {
 	Rand    io.Reader
 	Key     []byte
 	NewAEAD func(key []byte) (cipher.AEAD, error)
+	// SaltFilter rejects the replayed salts, nil disables it
+	SaltFilter shadowsocks.SaltFilter
 }
 
 func (c *Cipher) StreamConn(conn net.Conn) net.Conn {
 	return &cipherConn{Conn: conn, cipher: c}
 }
 
+// Authenticated reports the chunks are authenticated
+func (c *Cipher) Authenticated() bool {
+	return true
+}
+
 func (c *Cipher) KeySize() int {
 	return len(c.Key)
 }
@@ -60,17 +71,18 @@ func (c *Cipher) newDecrypt(salt []byte) (cipher.AEAD, error) {
 	return c.NewAEAD(subkey)
 }
 
-func (c *Cipher) initReader(r io.Reader) (*cipherReader, error) {
+// initReader reads the salt, it is to be checked once the first chunk is authenticated
+func (c *Cipher) initReader(r io.Reader) (*cipherReader, []byte, error) {
 	salt := make([]byte, c.SaltSize())
 	_, err := io.ReadFull(r, salt)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	aead, err := c.newDecrypt(salt)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	return newCipherReader(r, aead), nil
+	return newCipherReader(r, aead), salt, nil
 }
 
 func (c *Cipher) initWriter(w io.Writer) (*cipherWriter, error) {
@@ -83,6 +95,9 @@ func (c *Cipher) initWriter(w io.Writer) (*cipherWriter, error) {
 	if err != nil {
 		return nil, err
 	}
+	if c.SaltFilter != nil {
+		c.SaltFilter.Add(salt)
+	}
 	_, err = w.Write(salt)
 	if err != nil {
 		return nil, err
@@ -104,6 +119,9 @@ func (c *Cipher) Encrypt(dest, src []byte) (int, error) {
 	if len(dest) < saltSize+len(src)+aead.Overhead() {
 		return 0, io.ErrShortBuffer
 	}
+	if c.SaltFilter != nil {
+		c.SaltFilter.Add(salt)
+	}
 	b := aead.Seal(dest[saltSize:saltSize], _zerononce[:aead.NonceSize()], src, nil)
 	return saltSize + len(b), nil
 }
@@ -123,7 +141,14 @@ func (c *Cipher) Decrypt(dest, src []byte) (int, error) {
 		return 0, io.ErrShortBuffer
 	}
 	b, err := aead.Open(dest[:0], _zerononce[:aead.NonceSize()], src[saltSize:], nil)
-	return len(b), err
+	if err != nil {
+		return 0, err
+	}
+	// only the authenticated salts are recorded
+	if c.SaltFilter != nil && !c.SaltFilter.Check(salt) {
+		return 0, shadowsocks.ErrReplay
+	}
+	return len(b), nil
 }
 
 // payloadSizeMask is the maximum size of payload in bytes.
@@ -134,16 +159,27 @@ type cipherConn struct {
 	cipher *Cipher
 	r      *cipherReader
 	w      *cipherWriter
+	// salt is the salt of the reader until it is checked
+	salt []byte
 }
 
 func (c *cipherConn) Read(b []byte) (n int, err error) {
 	if c.r == nil {
-		c.r, err = c.cipher.initReader(c.Conn)
+		c.r, c.salt, err = c.cipher.initReader(c.Conn)
 		if err != nil {
 			return 0, err
 		}
 	}
-	return c.r.Read(b)
+	n, err = c.r.Read(b)
+	if err != nil || c.salt == nil {
+		return n, err
+	}
+	// only the authenticated salts are recorded, a replayed one stays unchecked and fails every read
+	if c.cipher.SaltFilter != nil && !c.cipher.SaltFilter.Check(c.salt) {
+		return 0, shadowsocks.ErrReplay
+	}
+	c.salt = nil
+	return n, nil
 }
 
 func (c *cipherConn) Write(b []byte) (n int, err error) {
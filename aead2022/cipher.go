@@ -0,0 +1,629 @@
+package aead2022
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/shadowsocks"
+	"lukechampine.com/blake3"
+)
+
+const (
+	headerTypeClient = 0
+	headerTypeServer = 1
+
+	// maxPaddingLength is the maximum length of the request padding.
+	maxPaddingLength = 900
+	// maxTimeDiff is the maximum difference between the header timestamp and the local clock.
+	maxTimeDiff = 30 * time.Second
+	// payloadSizeMask is the maximum size of payload in bytes.
+	payloadSizeMask = 0xFFFF
+)
+
+var (
+	errBadHeaderType = errors.New("bad header type")
+	errBadTimestamp  = errors.New("bad timestamp")
+	errBadSalt       = errors.New("bad request salt")
+	errWriteFirst    = errors.New("response written before request")
+)
+
+const subkeyContext = "shadowsocks 2022 session subkey"
+
+// RegisterCipher registers a cipher whose udp packets have the separate header encrypted by the block cipher,
+// the password may be a colon separated list of keys, the ones before the last are sent in identity headers.
+func RegisterCipher(method string, keyLen int, cipher func(key []byte) (cipher.AEAD, error), block func(key []byte) (cipher.Block, error)) {
+	shadowsocks.RegisterCipher(method, func(password string) (shadowsocks.ConnCipher, error) {
+		keys, err := DecodeKeys(password, keyLen)
+		if err != nil {
+			return nil, err
+		}
+		key := keys[len(keys)-1]
+		b, err := block(key)
+		if err != nil {
+			return nil, err
+		}
+		c := &Cipher{
+			Rand:         rand.Reader,
+			Key:          key,
+			IdentityKeys: keys[:len(keys)-1],
+			NewAEAD:      cipher,
+			NewBlock:     block,
+			Block:        b,
+		}
+		if shadowsocks.NewSaltFilter != nil {
+			c.SaltFilter = shadowsocks.NewSaltFilter()
+		}
+		return c, nil
+	})
+}
+
+// RegisterPacketAEADCipher registers a cipher whose udp packets are sealed as a whole by the packet AEAD
+func RegisterPacketAEADCipher(method string, keyLen int, cipher, packet func(key []byte) (cipher.AEAD, error)) {
+	shadowsocks.RegisterCipher(method, func(password string) (shadowsocks.ConnCipher, error) {
+		key, err := DecodeKey(password, keyLen)
+		if err != nil {
+			return nil, err
+		}
+		p, err := packet(key)
+		if err != nil {
+			return nil, err
+		}
+		c := &Cipher{Rand: rand.Reader, Key: key, NewAEAD: cipher, PacketAEAD: p}
+		if shadowsocks.NewSaltFilter != nil {
+			c.SaltFilter = shadowsocks.NewSaltFilter()
+		}
+		return c, nil
+	})
+}
+
+// DecodeKeys decodes the colon separated base64 pre-shared keys of the 2022 ciphers
+func DecodeKeys(password string, keyLen int) ([][]byte, error) {
+	list := strings.Split(password, ":")
+	keys := make([][]byte, 0, len(list))
+	for _, p := range list {
+		key, err := DecodeKey(p, keyLen)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// DecodeKey decodes the base64 pre-shared key of the 2022 ciphers
+func DecodeKey(password string, keyLen int) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(password)
+	if err != nil {
+		return nil, fmt.Errorf("bad pre-shared key: %v", err)
+	}
+	if len(key) != keyLen {
+		return nil, fmt.Errorf("bad pre-shared key length %d, want %d", len(key), keyLen)
+	}
+	return key, nil
+}
+
+type Cipher struct {
+	Rand io.Reader
+	Key  []byte
+	// IdentityKeys are the keys of the servers in front of the one holding Key,
+	// each identifies the next key in an identity header
+	IdentityKeys [][]byte
+	NewAEAD      func(key []byte) (cipher.AEAD, error)
+	// NewBlock creates the block cipher of the identity headers
+	NewBlock func(key []byte) (cipher.Block, error)
+	// Block encrypts the separate header of udp packets
+	Block cipher.Block
+	// PacketAEAD seals whole udp packets when Block is nil
+	PacketAEAD cipher.AEAD
+	// SaltFilter rejects the replayed salts of streams, nil disables it
+	SaltFilter shadowsocks.SaltFilter
+
+	mut       sync.Mutex
+	sessions  map[uint64]*packetSession
+	lastSweep time.Time
+}
+
+// StreamConn wraps the conn, the side that writes first sends the request header,
+// the side that reads first expects it.
+func (c *Cipher) StreamConn(conn net.Conn) net.Conn {
+	return &cipherConn{Conn: conn, cipher: c}
+}
+
+// Authenticated reports the chunks are authenticated
+func (c *Cipher) Authenticated() bool {
+	return true
+}
+
+func (c *Cipher) KeySize() int {
+	return len(c.Key)
+}
+
+func (c *Cipher) SaltSize() int {
+	return len(c.Key)
+}
+
+func (c *Cipher) newAEAD(salt []byte) (cipher.AEAD, error) {
+	material := make([]byte, 0, len(c.Key)+len(salt))
+	material = append(material, c.Key...)
+	material = append(material, salt...)
+	subkey := make([]byte, c.KeySize())
+	blake3.DeriveKey(subkey, subkeyContext, material)
+	return c.NewAEAD(subkey)
+}
+
+// Encrypt seals src into a client packet of a new udp session
+func (c *Cipher) Encrypt(dest, src []byte) (int, error) {
+	sess, err := c.newPacketSession(headerTypeClient, 0)
+	if err != nil {
+		return 0, err
+	}
+	return sess.Encrypt(dest, src)
+}
+
+// Decrypt opens a client packet without keeping any session state
+func (c *Cipher) Decrypt(dest, src []byte) (int, error) {
+	_, _, body, err := c.openPacket(src, c.sessionAEAD)
+	if err != nil {
+		return 0, err
+	}
+	_, data, err := parseBody(body, headerTypeClient)
+	if err != nil {
+		return 0, err
+	}
+	n := copy(dest, data)
+	if n < len(data) {
+		return 0, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// paddingLen returns a random padding length in [1, maxPaddingLength]
+func (c *Cipher) paddingLen() (int, error) {
+	var b [2]byte
+	_, err := io.ReadFull(c.Rand, b[:])
+	if err != nil {
+		return 0, err
+	}
+	return 1 + int(binary.BigEndian.Uint16(b[:]))%maxPaddingLength, nil
+}
+
+func checkTimestamp(b []byte) error {
+	ts := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	diff := time.Since(ts)
+	if diff > maxTimeDiff || diff < -maxTimeDiff {
+		return errBadTimestamp
+	}
+	return nil
+}
+
+func putTimestamp(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+}
+
+// addressLen returns the length of the socks address at the beginning of b
+func addressLen(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, io.ErrShortBuffer
+	}
+	var n int
+	switch b[0] {
+	case 0x01:
+		n = 1 + net.IPv4len + 2
+	case 0x04:
+		n = 1 + net.IPv6len + 2
+	case 0x03:
+		if len(b) < 2 {
+			return 0, io.ErrShortBuffer
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	default:
+		return 0, errors.New("unrecognized address type")
+	}
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+type cipherConn struct {
+	net.Conn
+	cipher      *Cipher
+	r           *cipherReader
+	w           *cipherWriter
+	requestSalt []byte
+}
+
+func (c *cipherConn) Read(b []byte) (n int, err error) {
+	if c.r == nil {
+		if c.w == nil {
+			c.r, err = c.readRequest()
+		} else {
+			c.r, err = c.readResponse()
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return c.r.Read(b)
+}
+
+func (c *cipherConn) Write(b []byte) (n int, err error) {
+	if c.w == nil {
+		if c.r == nil {
+			return c.writeRequest(b)
+		}
+		return c.writeResponse(b)
+	}
+	return c.w.Write(b)
+}
+
+func (c *cipherConn) initWriter() (*cipherWriter, []byte, error) {
+	salt := make([]byte, c.cipher.SaltSize())
+	_, err := io.ReadFull(c.cipher.Rand, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := c.cipher.newAEAD(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.cipher.SaltFilter != nil {
+		c.cipher.SaltFilter.Add(salt)
+	}
+	return newCipherWriter(c.Conn, aead), salt, nil
+}
+
+// writeRequest writes the request header, b must begin with the target socks address,
+// the rest of b goes out as the initial payload.
+func (c *cipherConn) writeRequest(b []byte) (int, error) {
+	addrLen, err := addressLen(b)
+	if err != nil {
+		return 0, err
+	}
+	w, salt, err := c.initWriter()
+	if err != nil {
+		return 0, err
+	}
+	overhead := w.aead.Overhead()
+
+	payload := b[addrLen:]
+	padding := 0
+	if len(payload) == 0 {
+		padding, err = c.cipher.paddingLen()
+		if err != nil {
+			return 0, err
+		}
+	}
+	max := payloadSizeMask - addrLen - 2 - padding
+	if len(payload) > max {
+		payload = payload[:max]
+	}
+	varLen := addrLen + 2 + padding + len(payload)
+
+	buf := make([]byte, 0, len(salt)+len(c.cipher.IdentityKeys)*identityHeaderLen+1+8+2+overhead+varLen+overhead)
+	buf = append(buf, salt...)
+	buf, err = c.cipher.appendIdentityHeaders(buf, salt)
+	if err != nil {
+		return 0, err
+	}
+
+	fixed := buf[len(buf) : len(buf)+1+8+2]
+	fixed[0] = headerTypeClient
+	putTimestamp(fixed[1:9])
+	binary.BigEndian.PutUint16(fixed[9:], uint16(varLen))
+	buf = w.seal(buf, fixed)
+
+	variable := make([]byte, 0, varLen)
+	variable = append(variable, b[:addrLen]...)
+	variable = append(variable, byte(padding>>8), byte(padding))
+	variable = append(variable, make([]byte, padding)...)
+	variable = append(variable, payload...)
+	buf = w.seal(buf, variable)
+
+	_, err = c.Conn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	c.w = w
+	c.requestSalt = salt
+
+	n := addrLen + len(payload)
+	if n < len(b) {
+		m, err := w.Write(b[n:])
+		return n + m, err
+	}
+	return n, nil
+}
+
+// writeResponse writes the response header carrying the request salt, with b as the first payload.
+func (c *cipherConn) writeResponse(b []byte) (int, error) {
+	if c.requestSalt == nil {
+		return 0, errWriteFirst
+	}
+	w, salt, err := c.initWriter()
+	if err != nil {
+		return 0, err
+	}
+	overhead := w.aead.Overhead()
+
+	payload := b
+	if len(payload) > payloadSizeMask {
+		payload = payload[:payloadSizeMask]
+	}
+	fixedLen := 1 + 8 + len(c.requestSalt) + 2
+
+	buf := make([]byte, 0, len(salt)+fixedLen+overhead+len(payload)+overhead)
+	buf = append(buf, salt...)
+
+	fixed := buf[len(buf) : len(buf)+fixedLen]
+	fixed[0] = headerTypeServer
+	putTimestamp(fixed[1:9])
+	copy(fixed[9:], c.requestSalt)
+	binary.BigEndian.PutUint16(fixed[fixedLen-2:], uint16(len(payload)))
+	buf = w.seal(buf, fixed)
+	buf = w.seal(buf, payload)
+
+	_, err = c.Conn.Write(buf)
+	if err != nil {
+		return 0, err
+	}
+	c.w = w
+
+	n := len(payload)
+	if n < len(b) {
+		m, err := w.Write(b[n:])
+		return n + m, err
+	}
+	return n, nil
+}
+
+func (c *cipherConn) readSalt() ([]byte, error) {
+	salt := make([]byte, c.cipher.SaltSize())
+	_, err := io.ReadFull(c.Conn, salt)
+	if err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+func (c *cipherConn) initReader(salt []byte) (*cipherReader, error) {
+	aead, err := c.cipher.newAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	return newCipherReader(c.Conn, aead), nil
+}
+
+// checkSalt rejects a replayed salt, it is called once the first chunk is authenticated
+// so that only the authenticated salts are recorded.
+func (c *cipherConn) checkSalt(salt []byte) error {
+	if c.cipher.SaltFilter != nil && !c.cipher.SaltFilter.Check(salt) {
+		return shadowsocks.ErrReplay
+	}
+	return nil
+}
+
+func (c *cipherConn) readRequest() (*cipherReader, error) {
+	salt, err := c.readSalt()
+	if err != nil {
+		return nil, err
+	}
+	return c.readRequestHeader(salt)
+}
+
+// readRequestHeader reads the request header following the salt, the address and the initial payload
+// are left for the following reads, the padding is discarded.
+func (c *cipherConn) readRequestHeader(salt []byte) (*cipherReader, error) {
+	r, err := c.initReader(salt)
+	if err != nil {
+		return nil, err
+	}
+	fixed, err := r.open(1 + 8 + 2)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkSalt(salt)
+	if err != nil {
+		return nil, err
+	}
+	if fixed[0] != headerTypeClient {
+		return nil, errBadHeaderType
+	}
+	err = checkTimestamp(fixed[1:9])
+	if err != nil {
+		return nil, err
+	}
+	varLen := int(binary.BigEndian.Uint16(fixed[9:]))
+
+	variable, err := r.open(varLen)
+	if err != nil {
+		return nil, err
+	}
+	addrLen, err := addressLen(variable)
+	if err != nil {
+		return nil, err
+	}
+	if len(variable) < addrLen+2 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	padding := int(binary.BigEndian.Uint16(variable[addrLen:]))
+	if len(variable) < addrLen+2+padding {
+		return nil, io.ErrUnexpectedEOF
+	}
+	leftover := make([]byte, 0, len(variable)-2-padding)
+	leftover = append(leftover, variable[:addrLen]...)
+	leftover = append(leftover, variable[addrLen+2+padding:]...)
+	r.leftover = leftover
+	c.requestSalt = salt
+	return r, nil
+}
+
+// readResponse reads the response header and checks it answers our request.
+func (c *cipherConn) readResponse() (*cipherReader, error) {
+	salt, err := c.readSalt()
+	if err != nil {
+		return nil, err
+	}
+	r, err := c.initReader(salt)
+	if err != nil {
+		return nil, err
+	}
+	fixedLen := 1 + 8 + len(c.requestSalt) + 2
+	fixed, err := r.open(fixedLen)
+	if err != nil {
+		return nil, err
+	}
+	err = c.checkSalt(salt)
+	if err != nil {
+		return nil, err
+	}
+	if fixed[0] != headerTypeServer {
+		return nil, errBadHeaderType
+	}
+	err = checkTimestamp(fixed[1:9])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fixed[9:fixedLen-2], c.requestSalt) {
+		return nil, errBadSalt
+	}
+	size := int(binary.BigEndian.Uint16(fixed[fixedLen-2:]))
+	payload, err := r.open(size)
+	if err != nil {
+		return nil, err
+	}
+	r.leftover = payload
+	return r, nil
+}
+
+type cipherWriter struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	buf   []byte
+}
+
+// newCipherWriter wraps an io.Writer with AEAD encryption.
+func newCipherWriter(w io.Writer, aead cipher.AEAD) *cipherWriter {
+	return &cipherWriter{
+		w:     w,
+		aead:  aead,
+		buf:   make([]byte, 2+aead.Overhead()+payloadSizeMask+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+	}
+}
+
+// seal appends the sealed plaintext to dst.
+func (w *cipherWriter) seal(dst, plaintext []byte) []byte {
+	dst = w.aead.Seal(dst, w.nonce, plaintext, nil)
+	increment(w.nonce)
+	return dst
+}
+
+// Write encrypts b and writes to the embedded io.Writer.
+func (w *cipherWriter) Write(b []byte) (int, error) {
+	overhead := w.aead.Overhead()
+	n := 0
+	for n < len(b) {
+		buf := w.buf
+		payloadBuf := buf[2+overhead : 2+overhead+payloadSizeMask]
+		nr := copy(payloadBuf, b[n:])
+		n += nr
+		buf = buf[:2+overhead+nr+overhead]
+		payloadBuf = payloadBuf[:nr]
+		binary.BigEndian.PutUint16(buf[:2], uint16(nr))
+		w.aead.Seal(buf[:0], w.nonce, buf[:2], nil)
+		increment(w.nonce)
+
+		w.aead.Seal(payloadBuf[:0], w.nonce, payloadBuf, nil)
+		increment(w.nonce)
+
+		_, err := w.w.Write(buf)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+type cipherReader struct {
+	r        io.Reader
+	aead     cipher.AEAD
+	nonce    []byte
+	buf      []byte
+	leftover []byte
+}
+
+// newCipherReader wraps an io.Reader with AEAD decryption.
+func newCipherReader(r io.Reader, aead cipher.AEAD) *cipherReader {
+	return &cipherReader{
+		r:     r,
+		aead:  aead,
+		buf:   make([]byte, payloadSizeMask+aead.Overhead()),
+		nonce: make([]byte, aead.NonceSize()),
+	}
+}
+
+// open reads and decrypts a chunk of size bytes.
+func (r *cipherReader) open(size int) ([]byte, error) {
+	buf := r.buf[:size+r.aead.Overhead()]
+	_, err := io.ReadFull(r.r, buf)
+	if err != nil {
+		return nil, err
+	}
+	_, err = r.aead.Open(buf[:0], r.nonce, buf, nil)
+	increment(r.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+// Read reads from the embedded io.Reader, decrypts and writes to b.
+func (r *cipherReader) Read(b []byte) (int, error) {
+	// copy decrypted bytes (if any) from previous record first
+	if len(r.leftover) > 0 {
+		n := copy(b, r.leftover)
+		r.leftover = r.leftover[n:]
+		return n, nil
+	}
+
+	// decrypt payload size
+	buf, err := r.open(2)
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(buf))
+
+	// decrypt payload
+	buf, err = r.open(size)
+	if err != nil {
+		return 0, err
+	}
+
+	m := copy(b, buf)
+	if m < size { // insufficient len(b), keep leftover for next read
+		r.leftover = buf[m:size]
+	}
+	return m, nil
+}
+
+// increment little-endian encoded unsigned integer b. Wrap around on overflow.
+func increment(b []byte) {
+	for i := range b {
+		b[i]++
+		if b[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package aead2022
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/wzshiming/shadowsocks"
+	"lukechampine.com/blake3"
+)
+
+const (
+	identityKeyContext = "shadowsocks 2022 identity subkey"
+	// identityHeaderLen is the length of an identity header
+	identityHeaderLen = 16
+)
+
+var (
+	errNoIdentity  = errors.New("identity headers need a block cipher")
+	errUnknownUser = errors.New("unknown user")
+)
+
+// keyHash returns the identity of the key
+func keyHash(key []byte) []byte {
+	sum := blake3.Sum256(key)
+	return sum[:identityHeaderLen]
+}
+
+// identityBlock returns the block cipher of the identity header sent under key
+func (c *Cipher) identityBlock(key, salt []byte) (cipher.Block, error) {
+	if c.NewBlock == nil {
+		return nil, errNoIdentity
+	}
+	material := make([]byte, 0, len(key)+len(salt))
+	material = append(material, key...)
+	material = append(material, salt...)
+	subkey := make([]byte, len(key))
+	blake3.DeriveKey(subkey, identityKeyContext, material)
+	return c.NewBlock(subkey)
+}
+
+// nextKey returns the key identified under the i-th identity key
+func (c *Cipher) nextKey(i int) []byte {
+	if i+1 < len(c.IdentityKeys) {
+		return c.IdentityKeys[i+1]
+	}
+	return c.Key
+}
+
+// appendIdentityHeaders appends the identity headers of a stream to dst
+func (c *Cipher) appendIdentityHeaders(dst, salt []byte) ([]byte, error) {
+	for i, key := range c.IdentityKeys {
+		block, err := c.identityBlock(key, salt)
+		if err != nil {
+			return nil, err
+		}
+		start := len(dst)
+		dst = append(dst, keyHash(c.nextKey(i))...)
+		block.Encrypt(dst[start:], dst[start:])
+	}
+	return dst, nil
+}
+
+// appendPacketIdentityHeaders appends the identity headers of a packet to dst
+func (c *Cipher) appendPacketIdentityHeaders(dst, header []byte) ([]byte, error) {
+	for i, key := range c.IdentityKeys {
+		if c.NewBlock == nil {
+			return nil, errNoIdentity
+		}
+		block, err := c.NewBlock(key)
+		if err != nil {
+			return nil, err
+		}
+		start := len(dst)
+		dst = append(dst, keyHash(c.nextKey(i))...)
+		xorBytes(dst[start:], dst[start:], header)
+		block.Encrypt(dst[start:], dst[start:])
+	}
+	return dst, nil
+}
+
+// xorBytes sets dst[i] = a[i] ^ b[i] for i < len(dst)
+func xorBytes(dst, a, b []byte) {
+	for i := range dst {
+		dst[i] = a[i] ^ b[i]
+	}
+}
+
+// findUser returns the user whose 2022 key has the identity
+func findUser(users []*shadowsocks.User, identity []byte) (*shadowsocks.User, *Cipher, error) {
+	for _, user := range users {
+		c, ok := user.ConnCipher.(*Cipher)
+		if !ok {
+			continue
+		}
+		if subtle.ConstantTimeCompare(keyHash(c.Key), identity) == 1 {
+			return user, c, nil
+		}
+	}
+	return nil, nil, errUnknownUser
+}
+
+// StreamConnUser reads the salt and the identity header of conn,
+// the rest of the stream is decrypted with the key of the user.
+func (c *Cipher) StreamConnUser(conn net.Conn, users []*shadowsocks.User) (net.Conn, *shadowsocks.User, error) {
+	salt := make([]byte, c.SaltSize())
+	_, err := io.ReadFull(conn, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := c.identityBlock(c.Key, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	identity := make([]byte, identityHeaderLen)
+	_, err = io.ReadFull(conn, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	block.Decrypt(identity, identity)
+	user, uc, err := findUser(users, identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	cc := &cipherConn{Conn: conn, cipher: uc}
+	cc.r, err = cc.readRequestHeader(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cc, user, nil
+}
+
+// OpenPacketUser decrypts a client packet whose identity header names the user,
+// the replies are encrypted with the key of the user.
+func (c *Cipher) OpenPacketUser(dst, src []byte, users []*shadowsocks.User) (int, shadowsocks.PacketSession, *shadowsocks.User, error) {
+	if c.Block == nil || c.NewBlock == nil {
+		return 0, nil, nil, errNoIdentity
+	}
+	if len(src) < separateHeaderLen+identityHeaderLen+16 {
+		return 0, nil, nil, errShortPacket
+	}
+	var header [separateHeaderLen]byte
+	c.Block.Decrypt(header[:], src[:separateHeaderLen])
+	identity := make([]byte, identityHeaderLen)
+	c.Block.Decrypt(identity, src[separateHeaderLen:separateHeaderLen+identityHeaderLen])
+	xorBytes(identity, identity, header[:])
+	user, uc, err := findUser(users, identity)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	sessionID := binary.BigEndian.Uint64(header[:8])
+	packetID := binary.BigEndian.Uint64(header[8:])
+	aead, err := uc.clientSessionAEAD(sessionID)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	body, err := aead.Open(nil, header[4:], src[separateHeaderLen+identityHeaderLen:], nil)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	n, sess, err := uc.acceptPacket(dst, sessionID, packetID, body)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return n, sess, user, nil
+}
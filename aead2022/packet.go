@@ -0,0 +1,382 @@
+package aead2022
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wzshiming/shadowsocks"
+)
+
+const (
+	// sessionTimeout is how long an idle udp session is kept by the server
+	sessionTimeout = 5 * time.Minute
+	// separateHeaderLen is the length of the session id and packet id
+	separateHeaderLen = 8 + 8
+)
+
+var (
+	errReplay       = errors.New("packet replayed")
+	errBadSessionID = errors.New("bad session id")
+	errShortPacket  = errors.New("packet too short")
+	errNoPacketAEAD = errors.New("no packet aead")
+)
+
+// packetOverhead returns the bytes a udp packet adds to its main header
+func (c *Cipher) packetOverhead() int {
+	if c.Block != nil {
+		return separateHeaderLen + len(c.IdentityKeys)*identityHeaderLen + 16
+	}
+	return c.PacketAEAD.NonceSize() + separateHeaderLen + c.PacketAEAD.Overhead()
+}
+
+// sessionAEAD returns the AEAD of the session, whole packet ciphers don't have one
+func (c *Cipher) sessionAEAD(sessionID uint64) (cipher.AEAD, error) {
+	if c.Block == nil {
+		return nil, nil
+	}
+	var id [8]byte
+	binary.BigEndian.PutUint64(id[:], sessionID)
+	return c.newAEAD(id[:])
+}
+
+// sealPacket appends the udp packet carrying body to dst.
+func (c *Cipher) sealPacket(dst []byte, aead cipher.AEAD, sessionID, packetID uint64, body []byte) ([]byte, error) {
+	var header [separateHeaderLen]byte
+	binary.BigEndian.PutUint64(header[:8], sessionID)
+	binary.BigEndian.PutUint64(header[8:], packetID)
+
+	if c.Block == nil {
+		if c.PacketAEAD == nil {
+			return nil, errNoPacketAEAD
+		}
+		nonce := make([]byte, c.PacketAEAD.NonceSize())
+		_, err := io.ReadFull(c.Rand, nonce)
+		if err != nil {
+			return nil, err
+		}
+		plaintext := make([]byte, 0, len(header)+len(body))
+		plaintext = append(plaintext, header[:]...)
+		plaintext = append(plaintext, body...)
+		dst = append(dst, nonce...)
+		return c.PacketAEAD.Seal(dst, nonce, plaintext, nil), nil
+	}
+
+	block := c.Block
+	if len(c.IdentityKeys) != 0 {
+		var err error
+		block, err = c.NewBlock(c.IdentityKeys[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	start := len(dst)
+	dst = append(dst, header[:]...)
+	block.Encrypt(dst[start:], header[:])
+	dst, err := c.appendPacketIdentityHeaders(dst, header[:])
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, header[4:], body, nil), nil
+}
+
+// openPacket decrypts the udp packet, aead returns the AEAD of the session the packet claims.
+func (c *Cipher) openPacket(src []byte, aead func(sessionID uint64) (cipher.AEAD, error)) (sessionID, packetID uint64, body []byte, err error) {
+	if c.Block == nil {
+		if c.PacketAEAD == nil {
+			return 0, 0, nil, errNoPacketAEAD
+		}
+		nonceSize := c.PacketAEAD.NonceSize()
+		if len(src) < nonceSize+separateHeaderLen+c.PacketAEAD.Overhead() {
+			return 0, 0, nil, errShortPacket
+		}
+		plaintext, err := c.PacketAEAD.Open(nil, src[:nonceSize], src[nonceSize:], nil)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		sessionID = binary.BigEndian.Uint64(plaintext[:8])
+		packetID = binary.BigEndian.Uint64(plaintext[8:16])
+		return sessionID, packetID, plaintext[separateHeaderLen:], nil
+	}
+
+	if len(src) < separateHeaderLen+16 {
+		return 0, 0, nil, errShortPacket
+	}
+	var header [separateHeaderLen]byte
+	c.Block.Decrypt(header[:], src[:separateHeaderLen])
+	sessionID = binary.BigEndian.Uint64(header[:8])
+	packetID = binary.BigEndian.Uint64(header[8:])
+	a, err := aead(sessionID)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	body, err = a.Open(nil, header[4:], src[separateHeaderLen:], nil)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return sessionID, packetID, body, nil
+}
+
+// parseBody checks the main header sent by the peer of the header type,
+// and returns the client session id of server packets and the socks address with the payload.
+func parseBody(body []byte, typ byte) (clientID uint64, data []byte, err error) {
+	if len(body) < 1+8 {
+		return 0, nil, errShortPacket
+	}
+	if body[0] != typ {
+		return 0, nil, errBadHeaderType
+	}
+	err = checkTimestamp(body[1:9])
+	if err != nil {
+		return 0, nil, err
+	}
+	body = body[9:]
+	if typ == headerTypeServer {
+		if len(body) < 8 {
+			return 0, nil, errShortPacket
+		}
+		clientID = binary.BigEndian.Uint64(body[:8])
+		body = body[8:]
+	}
+	if len(body) < 2 {
+		return 0, nil, errShortPacket
+	}
+	padding := int(binary.BigEndian.Uint16(body[:2]))
+	if len(body) < 2+padding {
+		return 0, nil, errShortPacket
+	}
+	return clientID, body[2+padding:], nil
+}
+
+// NewPacketSession starts a client udp session
+func (c *Cipher) NewPacketSession() (shadowsocks.PacketSession, error) {
+	return c.newPacketSession(headerTypeClient, 0)
+}
+
+func (c *Cipher) newPacketSession(typ byte, clientID uint64) (*packetSession, error) {
+	var id [8]byte
+	_, err := io.ReadFull(c.Rand, id[:])
+	if err != nil {
+		return nil, err
+	}
+	sessionID := binary.BigEndian.Uint64(id[:])
+	aead, err := c.sessionAEAD(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return &packetSession{
+		cipher:    c,
+		typ:       typ,
+		sessionID: sessionID,
+		aead:      aead,
+		clientID:  clientID,
+	}, nil
+}
+
+// OpenPacket decrypts a client packet and returns the server session it belongs to
+func (c *Cipher) OpenPacket(dst, src []byte) (int, shadowsocks.PacketSession, error) {
+	sessionID, packetID, body, err := c.openPacket(src, c.clientSessionAEAD)
+	if err != nil {
+		return 0, nil, err
+	}
+	return c.acceptPacket(dst, sessionID, packetID, body)
+}
+
+// acceptPacket checks the client packet body of the session, and copies the socks address with the payload to dst
+func (c *Cipher) acceptPacket(dst []byte, sessionID, packetID uint64, body []byte) (int, shadowsocks.PacketSession, error) {
+	_, data, err := parseBody(body, headerTypeClient)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	sess, err := c.serverSession(sessionID)
+	if err != nil {
+		return 0, nil, err
+	}
+	if !sess.accept(packetID) {
+		return 0, nil, errReplay
+	}
+	n := copy(dst, data)
+	if n < len(data) {
+		return 0, nil, io.ErrShortBuffer
+	}
+	return n, sess, nil
+}
+
+// clientSessionAEAD returns the AEAD of the client session
+func (c *Cipher) clientSessionAEAD(sessionID uint64) (cipher.AEAD, error) {
+	c.mut.Lock()
+	sess, ok := c.sessions[sessionID]
+	c.mut.Unlock()
+	if ok {
+		return sess.remoteAEAD, nil
+	}
+	return c.sessionAEAD(sessionID)
+}
+
+// serverSession returns the server session of the client session, creating it if needed
+func (c *Cipher) serverSession(clientID uint64) (*packetSession, error) {
+	now := time.Now()
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	if c.sessions == nil {
+		c.sessions = map[uint64]*packetSession{}
+		c.lastSweep = now
+	}
+	if now.Sub(c.lastSweep) > sessionTimeout {
+		for id, sess := range c.sessions {
+			if now.Sub(sess.lastSeen()) > sessionTimeout {
+				delete(c.sessions, id)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	sess, ok := c.sessions[clientID]
+	if ok {
+		return sess, nil
+	}
+	sess, err := c.newPacketSession(headerTypeServer, clientID)
+	if err != nil {
+		return nil, err
+	}
+	sess.remoteID = clientID
+	sess.remoteAEAD, err = c.sessionAEAD(clientID)
+	if err != nil {
+		return nil, err
+	}
+	sess.hasRemote = true
+	c.sessions[clientID] = sess
+	return sess, nil
+}
+
+// packetSession is one side of a udp session.
+type packetSession struct {
+	cipher    *Cipher
+	typ       byte
+	sessionID uint64
+	aead      cipher.AEAD
+	// clientID is the client session id, sent back in server packets
+	clientID uint64
+
+	mut        sync.Mutex
+	packetID   uint64
+	remoteID   uint64
+	remoteAEAD cipher.AEAD
+	hasRemote  bool
+	window     slidingWindow
+	last       time.Time
+}
+
+func (s *packetSession) lastSeen() time.Time {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.last
+}
+
+// accept records the packet id of the remote session and reports whether it is new
+func (s *packetSession) accept(packetID uint64) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !s.window.check(packetID) {
+		return false
+	}
+	s.last = time.Now()
+	return true
+}
+
+// Encrypt seals src, the socks address with the payload, into a packet of this session.
+func (s *packetSession) Encrypt(dst, src []byte) (int, error) {
+	bodyLen := 1 + 8 + 2 + len(src)
+	if s.typ == headerTypeServer {
+		bodyLen += 8
+	}
+	if len(dst) < s.cipher.packetOverhead()+bodyLen {
+		return 0, io.ErrShortBuffer
+	}
+
+	s.mut.Lock()
+	packetID := s.packetID
+	s.packetID++
+	s.mut.Unlock()
+
+	body := make([]byte, bodyLen)
+	body[0] = s.typ
+	putTimestamp(body[1:9])
+	i := 9
+	if s.typ == headerTypeServer {
+		binary.BigEndian.PutUint64(body[i:], s.clientID)
+		i += 8
+	}
+	binary.BigEndian.PutUint16(body[i:], 0)
+	i += 2
+	copy(body[i:], src)
+
+	b, err := s.cipher.sealPacket(dst[:0], s.aead, s.sessionID, packetID, body)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Decrypt opens a packet sent by the other side of this session.
+func (s *packetSession) Decrypt(dst, src []byte) (int, error) {
+	var candidate cipher.AEAD
+	sessionID, packetID, body, err := s.cipher.openPacket(src, func(sessionID uint64) (cipher.AEAD, error) {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		if s.hasRemote && s.remoteID == sessionID {
+			return s.remoteAEAD, nil
+		}
+		a, err := s.cipher.sessionAEAD(sessionID)
+		candidate = a
+		return a, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	typ := byte(headerTypeServer)
+	if s.typ == headerTypeServer {
+		typ = headerTypeClient
+	}
+	clientID, data, err := parseBody(body, typ)
+	if err != nil {
+		return 0, err
+	}
+	if typ == headerTypeServer && clientID != s.sessionID {
+		return 0, errBadSessionID
+	}
+
+	s.mut.Lock()
+	if !s.hasRemote || s.remoteID != sessionID {
+		if s.typ == headerTypeServer {
+			s.mut.Unlock()
+			return 0, errBadSessionID
+		}
+		// the server started a new session
+		if candidate == nil {
+			candidate, err = s.cipher.sessionAEAD(sessionID)
+			if err != nil {
+				s.mut.Unlock()
+				return 0, err
+			}
+		}
+		s.remoteID = sessionID
+		s.remoteAEAD = candidate
+		s.hasRemote = true
+		s.window = slidingWindow{}
+	}
+	s.mut.Unlock()
+	if !s.accept(packetID) {
+		return 0, errReplay
+	}
+
+	n := copy(dst, data)
+	if n < len(data) {
+		return 0, io.ErrShortBuffer
+	}
+	return n, nil
+}
@@ -0,0 +1,40 @@
+package aead2022
+
+const (
+	blockBitLog = 6
+	blockBits   = 1 << blockBitLog
+	ringBlocks  = 1 << 5
+	windowSize  = (ringBlocks - 1) * blockBits
+	blockMask   = ringBlocks - 1
+	bitMask     = blockBits - 1
+)
+
+// slidingWindow rejects packet ids seen before or too far behind the newest one, as in RFC 6479.
+type slidingWindow struct {
+	last uint64
+	ring [ringBlocks]uint64
+}
+
+// check records the packet id and reports whether it was accepted
+func (w *slidingWindow) check(id uint64) bool {
+	indexBlock := id >> blockBitLog
+	if id > w.last {
+		// move the window forward
+		current := w.last >> blockBitLog
+		diff := indexBlock - current
+		if diff > ringBlocks {
+			diff = ringBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			w.ring[i&blockMask] = 0
+		}
+		w.last = id
+	} else if w.last-id > windowSize {
+		return false
+	}
+	indexBlock &= blockMask
+	indexBit := id & bitMask
+	old := w.ring[indexBlock]
+	w.ring[indexBlock] = old | 1<<indexBit
+	return w.ring[indexBlock] != old
+}
@@ -14,6 +14,13 @@ type ConnCipher interface {
 	Encrypt(dist, src []byte) (n int, err error)
 }
 
+// AuthenticatedCipher is implemented by the ciphers authenticating what they decrypt, such as the AEAD ciphers,
+// a wrong key fails instead of decrypting garbage, so only they can tell the users of a user table apart.
+type AuthenticatedCipher interface {
+	// Authenticated reports whether the cipher authenticates what it decrypts
+	Authenticated() bool
+}
+
 var registerCipher = map[string]func(password string) (ConnCipher, error){}
 
 func RegisterCipher(method string, fun func(password string) (ConnCipher, error)) {
@@ -1,10 +1,11 @@
 package shadowsocks
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
-	"net/url"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,9 @@ type Dialer struct {
 	// ProxyDial specifies the optional dial function for
 	// establishing the transport connection.
 	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the optional listen function for
+	// the udp relay through the proxy server.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
 	// Cipher use cipher protocol
 	Cipher string
 	// Password use password authentication
@@ -30,43 +34,37 @@ type Dialer struct {
 	// Timeout is the maximum amount of time a dial will wait for
 	// a connect to complete. The default is no timeout
 	Timeout time.Duration
+	// Plugin is the SIP003 plugin executable the proxy connections go through
+	Plugin string
+	// PluginOptions is passed to the plugin in SS_PLUGIN_OPTIONS
+	PluginOptions string
+	// UDPOverTCP relays the udp packets in a tcp connection instead, for the networks blocking udp,
+	// the server needs to support the udp over tcp version 2
+	UDPOverTCP bool
+	// Logger error log
+	Logger Logger
+
+	pluginMut sync.Mutex
+	plugin    *Plugin
 }
 
 // NewDialer returns a new Dialer that dials through the provided
 // proxy server's network and address.
 func NewDialer(addr string) (*Dialer, error) {
-	d := &Dialer{
-		ProxyNetwork: "tcp",
-		Timeout:      time.Minute,
-	}
-	u, err := url.Parse(addr)
+	c, cipher, err := parseEndpoint(addr)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "ss", "shadowsocks":
-	default:
-		return nil, fmt.Errorf("unsupported protocol '%s'", u.Scheme)
-	}
-	host := u.Host
-	port := u.Port()
-	if port == "" {
-		port = "8379"
-		hostname := u.Hostname()
-		host = net.JoinHostPort(hostname, port)
-	}
-	if u.User != nil {
-		d.Cipher, d.Password, err = GetCipherAndPasswordFromUserinfo(u.User)
-		if err != nil {
-			return nil, err
-		}
-	}
-	d.ProxyAddress = host
-	cipher, err := NewCipher(d.Cipher, d.Password)
-	if err != nil {
-		return nil, err
+	d := &Dialer{
+		ProxyNetwork:  "tcp",
+		ProxyAddress:  c.Address,
+		Cipher:        c.Cipher,
+		Password:      c.Password,
+		ConnCipher:    cipher,
+		Timeout:       time.Minute,
+		Plugin:        c.Plugin,
+		PluginOptions: c.PluginOptions,
 	}
-	d.ConnCipher = cipher
 	return d, nil
 }
 
@@ -77,6 +75,8 @@ func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.
 		return nil, fmt.Errorf("unsupported network %q", network)
 	case "tcp", "tcp4", "tcp6":
 		return d.connect(ctx, address)
+	case "udp", "udp4", "udp6":
+		return d.dialPacket(ctx, network, address)
 	}
 }
 
@@ -85,30 +85,85 @@ func (d *Dialer) Dial(network, address string) (net.Conn, error) {
 	return d.DialContext(context.Background(), network, address)
 }
 
+// ListenPacket listens on the local network address and relays the packets through the proxy server.
+func (d *Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	case "udp", "udp4", "udp6":
+	}
+	if d.UDPOverTCP {
+		return d.dialUDPOverTCP(ctx, nil)
+	}
+	c := &PacketClient{
+		ProxyNetwork: packetNetwork(d.ProxyNetwork),
+		ProxyAddress: d.ProxyAddress,
+		ProxyPacket:  d.ProxyPacket,
+		Cipher:       d.Cipher,
+		Password:     d.Password,
+		ConnCipher:   d.ConnCipher,
+		IsResolve:    d.IsResolve,
+		Resolver:     d.Resolver,
+	}
+	return c.ListenPacket(ctx, network, address)
+}
+
+// dialPacket returns a conn of the packets to and from the address relayed through the proxy server.
+func (d *Dialer) dialPacket(ctx context.Context, network, address string) (net.Conn, error) {
+	address, err := d.resolve(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := parseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if d.UDPOverTCP {
+		return d.dialUDPOverTCP(ctx, addr)
+	}
+	conn, err := d.ListenPacket(ctx, network, ":0")
+	if err != nil {
+		return nil, err
+	}
+	return &packetConn{
+		PacketConn: conn,
+		remote:     toPacketAddr(addr),
+	}, nil
+}
+
+// resolve resolves the host of the address locally if IsResolve is set
+func (d *Dialer) resolve(ctx context.Context, address string) (string, error) {
+	if !d.IsResolve {
+		return address, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ipaddr, err := d.resolver().LookupIP(ctx, "ip", host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ipaddr[0].String(), port), nil
+}
+
 func (d *Dialer) connect(ctx context.Context, address string) (net.Conn, error) {
-	if d.IsResolve {
-		host, port, err := net.SplitHostPort(address)
-		if err != nil {
-			return nil, err
-		}
-		if host != "" {
-			ip := net.ParseIP(host)
-			if ip == nil {
-				ipaddr, err := d.resolver().LookupIP(ctx, "ip", host)
-				if err != nil {
-					return nil, err
-				}
-				host := ipaddr[0].String()
-				address = net.JoinHostPort(host, port)
-			}
-		}
+	address, err := d.resolve(ctx, address)
+	if err != nil {
+		return nil, err
 	}
 
 	addr, err := parseAddress(address)
 	if err != nil {
 		return nil, err
 	}
+	return d.connectAddress(ctx, addr)
+}
 
+func (d *Dialer) connectAddress(ctx context.Context, addr *address) (net.Conn, error) {
 	conn, err := d.proxyDial(ctx, d.ProxyNetwork, d.ProxyAddress)
 	if err != nil {
 		return nil, err
@@ -129,8 +184,16 @@ func (d *Dialer) connect(ctx context.Context, address string) (net.Conn, error)
 
 	conn = d.ConnCipher.StreamConn(conn)
 
-	err = writeAddress(conn, addr)
+	// the address goes out in a single write, some ciphers put it in their request header
+	var buf bytes.Buffer
+	err = writeAddress(&buf, addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_, err = conn.Write(buf.Bytes())
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 	return conn, nil
@@ -143,7 +206,52 @@ func (d *Dialer) resolver() *net.Resolver {
 	return d.Resolver
 }
 
+// Close kills the plugin, if any
+func (d *Dialer) Close() error {
+	d.pluginMut.Lock()
+	defer d.pluginMut.Unlock()
+	if d.plugin == nil {
+		return nil
+	}
+	err := d.plugin.Close()
+	d.plugin = nil
+	return err
+}
+
+// pluginAddress starts the plugin on first use and returns the address it listens on
+func (d *Dialer) pluginAddress(ctx context.Context) (string, error) {
+	d.pluginMut.Lock()
+	defer d.pluginMut.Unlock()
+	if d.plugin != nil {
+		return d.plugin.LocalAddress, nil
+	}
+	local, err := freeAddress("127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	plugin := &Plugin{
+		Name:          d.Plugin,
+		Options:       d.PluginOptions,
+		RemoteAddress: d.ProxyAddress,
+		LocalAddress:  local,
+		Logger:        d.Logger,
+	}
+	err = plugin.Start(ctx)
+	if err != nil {
+		return "", err
+	}
+	d.plugin = plugin
+	return local, nil
+}
+
 func (d *Dialer) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.Plugin != "" {
+		local, err := d.pluginAddress(ctx)
+		if err != nil {
+			return nil, err
+		}
+		address = local
+	}
 	proxyDial := d.ProxyDial
 	if proxyDial == nil {
 		var dialer net.Dialer
@@ -151,3 +259,66 @@ func (d *Dialer) proxyDial(ctx context.Context, network, address string) (net.Co
 	}
 	return proxyDial(ctx, network, address)
 }
+
+// packetNetwork returns the udp network of the same family as the tcp network
+func packetNetwork(network string) string {
+	switch network {
+	case "tcp4":
+		return "udp4"
+	case "tcp6":
+		return "udp6"
+	}
+	return "udp"
+}
+
+// packetConn is a connected conn over a packet conn, the packets are sent to the remote address
+// and only those from it are read
+type packetConn struct {
+	net.PacketConn
+	remote net.Addr
+	// from is the source of the packets read, the first one from the port of a remote domain name,
+	// which is resolved by the server
+	from *net.UDPAddr
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	for {
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return n, err
+		}
+		if c.fromRemote(addr) {
+			return n, nil
+		}
+	}
+}
+
+// fromRemote reports whether the packet from addr comes from the remote address
+func (c *packetConn) fromRemote(addr net.Addr) bool {
+	a, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	if c.from == nil {
+		switch remote := c.remote.(type) {
+		case *net.UDPAddr:
+			c.from = remote
+		case *address:
+			if remote.Port != a.Port {
+				return false
+			}
+			c.from = a
+		default:
+			return false
+		}
+	}
+	return a.Port == c.from.Port && a.IP.Equal(c.from.IP)
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -1,54 +1,333 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/wzshiming/shadowsocks"
 	_ "github.com/wzshiming/shadowsocks/init"
 )
 
+var mode string
 var address string
+var httpAddress string
+var server string
 var cipher string
 var password string
+var plugin string
+var pluginOptions string
+var udpOverTCP bool
+var aclFile string
+var routeFile string
+var forwards listFlag
+var shutdownTimeout time.Duration
+var configFile string
+
+// listFlag is a flag given several times
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
 
 func init() {
+	flag.StringVar(&mode, "mode", "server", "server, local to run a SOCKS5 proxy forwarding through the server, tunnel, redir or tproxy")
 	flag.StringVar(&address, "a", ":8379", "listen on the address")
+	flag.StringVar(&server, "s", "", "the server address or SIP002 URI, in local mode")
+	flag.StringVar(&httpAddress, "http", "", "also listen as an HTTP proxy on the address, in local mode")
 	flag.StringVar(&cipher, "c", "chacha20-ietf-poly1305", fmt.Sprintf("cipher (%s)", strings.Join(shadowsocks.CipherList(), ", ")))
 	flag.StringVar(&password, "p", "password", "your password")
+	flag.StringVar(&plugin, "plugin", "", "SIP003 plugin executable")
+	flag.StringVar(&pluginOptions, "plugin-opts", "", "options passed to the plugin")
+	flag.BoolVar(&udpOverTCP, "uot", false, "udp over tcp")
+	flag.StringVar(&aclFile, "acl", "", "the ACL file restricting the targets, in server mode, read again on SIGHUP, the default denies the local networks")
+	flag.StringVar(&routeFile, "route", "", "the rules file routing the targets through the server, directly or blocking them, in local, redir and tproxy modes")
+	flag.StringVar(&configFile, "config", "", "the JSON configuration file of shadowsocks-libev or shadowsocks-rust, in server mode it replaces -a, -c, -p and -plugin and it is read again on SIGHUP, adding and removing the ports, in the other modes it gives the server and the local address")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 10*time.Second, "how long to wait for the open connections on SIGTERM, in server mode")
+	flag.Var(&forwards, "L", "local=remote, forward the local address to the remote one through the server, in tunnel mode")
 	flag.Parse()
 }
 
 func main() {
 	logger := log.New(os.Stderr, "[shadowsocks] ", log.LstdFlags)
-	go func() {
-		svc := &shadowsocks.Server{
-			Logger:   logger,
-			Cipher:   cipher,
-			Password: password,
+	if mode != "server" && configFile != "" {
+		err := loadLocalConfig()
+		if err != nil {
+			logger.Println(err)
+			os.Exit(1)
 		}
+	}
+	switch mode {
+	case "server":
+		runServer(logger)
+	case "local":
+		runLocal(logger)
+	case "tunnel":
+		runTunnel(logger)
+	case "redir":
+		runRedir(logger, shadowsocks.RedirRedirect)
+	case "tproxy":
+		runRedir(logger, shadowsocks.RedirTProxy)
+	default:
+		logger.Printf("unsupported mode %q", mode)
+		os.Exit(2)
+	}
+}
 
-		err := svc.ListenAndServe("tcp", address)
+func runServer(logger *log.Logger) {
+	configs, err := portConfigs()
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	supervisor := shadowsocks.NewSupervisor()
+	supervisor.Logger = logger
+	supervisor.UDPOverTCP = udpOverTCP
+	for _, config := range configs {
+		err := supervisor.Add(config)
 		if err != nil {
 			logger.Println(err)
+			supervisor.Shutdown(context.Background())
+			os.Exit(1)
 		}
-		os.Exit(1)
-	}()
-	go func() {
-		svc := &shadowsocks.PacketServer{
-			Logger:   logger,
-			Cipher:   cipher,
-			Password: password,
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt, syscall.SIGHUP)
+	sig := <-signals
+	for sig == syscall.SIGHUP {
+		// the ports are added and removed by the configuration,
+		// the open connections of the others go on with the previous settings
+		configs, err := portConfigs()
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err = supervisor.Apply(ctx, configs, false)
+			cancel()
 		}
+		if err != nil {
+			logger.Println("reload:", err)
+		} else {
+			logger.Println("reloaded")
+		}
+		sig = <-signals
+	}
+	logger.Printf("%s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	err = supervisor.Shutdown(ctx)
+	if err != nil {
+		logger.Println(err)
+		// the connections still open at the timeout are closed, which is a stop as requested
+		if !errors.Is(err, context.DeadlineExceeded) {
+			os.Exit(1)
+		}
+	}
+	os.Exit(0)
+}
 
-		err := svc.ListenAndServe("udp", address)
+// portConfigs returns the ports of the configuration file, or the one of the flags,
+// the ACL file is read again on each reload
+func portConfigs() ([]*shadowsocks.PortConfig, error) {
+	var servers []*shadowsocks.ServerConfig
+	if configFile != "" {
+		c, err := shadowsocks.LoadFileConfig(configFile)
 		if err != nil {
-			logger.Println(err)
+			return nil, err
+		}
+		servers, err = c.ServerConfigs()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", configFile, err)
+		}
+	} else {
+		servers = []*shadowsocks.ServerConfig{
+			{
+				Config: shadowsocks.Config{
+					Cipher:        cipher,
+					Password:      password,
+					Address:       address,
+					Plugin:        plugin,
+					PluginOptions: pluginOptions,
+				},
+				Mode: shadowsocks.ModeTCPAndUDP,
+			},
+		}
+	}
+	acl := shadowsocks.DefaultACL()
+	if aclFile != "" {
+		var err error
+		acl, err = shadowsocks.LoadACL(aclFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	configs := make([]*shadowsocks.PortConfig, 0, len(servers))
+	for _, server := range servers {
+		configs = append(configs, &shadowsocks.PortConfig{
+			ServerConfig: *server,
+			ACL:          acl,
+		})
+	}
+	return configs, nil
+}
+
+func runLocal(logger *log.Logger) {
+	dialer, err := newDialer()
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	dialer.Logger = logger
+	router, err := newRouter(dialer)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	if httpAddress != "" {
+		go func() {
+			local := shadowsocks.NewHTTPLocal(httpAddress, dialer)
+			local.ProxyDial = router.DialContext
+			local.Logger = logger
+			err := local.Run(context.Background())
+			if err != nil {
+				logger.Println(err)
+			}
+			dialer.Close()
+			os.Exit(1)
+		}()
+	}
+	local := shadowsocks.NewSOCKS5Local(address, dialer)
+	local.ProxyDial = router.DialContext
+	local.ProxyPacket = router.ListenPacket
+	local.Logger = logger
+	err = local.Run(context.Background())
+	if err != nil {
+		logger.Println(err)
+	}
+	dialer.Close()
+	os.Exit(1)
+}
+
+func runTunnel(logger *log.Logger) {
+	if len(forwards) == 0 {
+		logger.Println("the forwards are required in tunnel mode")
+		os.Exit(2)
+	}
+	dialer, err := newDialer()
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+	dialer.Logger = logger
+
+	errCh := make(chan error, len(forwards))
+	for _, forward := range forwards {
+		lr := strings.SplitN(forward, "=", 2)
+		if len(lr) != 2 {
+			logger.Printf("invalid forward %q, want local=remote", forward)
+			os.Exit(2)
 		}
+		tunnel := shadowsocks.NewTunnel(lr[0], lr[1], dialer)
+		tunnel.Logger = logger
+		go func() {
+			errCh <- tunnel.Run(context.Background())
+		}()
+	}
+	logger.Println(<-errCh)
+	dialer.Close()
+	os.Exit(1)
+}
+
+func runRedir(logger *log.Logger, redirMode shadowsocks.RedirMode) {
+	dialer, err := newDialer()
+	if err != nil {
+		logger.Println(err)
 		os.Exit(1)
-	}()
-	<-make(chan struct{})
+	}
+	dialer.Logger = logger
+	router, err := newRouter(dialer)
+	if err != nil {
+		logger.Println(err)
+		os.Exit(1)
+	}
+
+	redir := shadowsocks.NewRedir(address, redirMode, dialer)
+	redir.ProxyDial = router.DialContext
+	redir.ProxyPacket = router.ListenPacket
+	redir.Logger = logger
+	err = redir.Run(context.Background())
+	if err != nil {
+		logger.Println(err)
+	}
+	dialer.Close()
+	os.Exit(1)
+}
+
+// loadLocalConfig takes the server and the local address from the configuration file,
+// unless they are given by the flags
+func loadLocalConfig() error {
+	c, err := shadowsocks.LoadFileConfig(configFile)
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["s"] {
+		configs, err := c.ServerConfigs()
+		if err != nil {
+			return fmt.Errorf("%s: %w", configFile, err)
+		}
+		server = configs[0].String()
+	}
+	if !set["a"] && c.LocalAddr() != "" {
+		address = c.LocalAddr()
+	}
+	return nil
+}
+
+// newDialer returns the dialer of the server, given as a URI or as an address with the other flags
+func newDialer() (*shadowsocks.Dialer, error) {
+	if server == "" {
+		return nil, fmt.Errorf("the server is required in local mode")
+	}
+	uri := server
+	if !strings.Contains(server, "://") {
+		c := shadowsocks.Config{
+			Cipher:        cipher,
+			Password:      password,
+			Address:       server,
+			Plugin:        plugin,
+			PluginOptions: pluginOptions,
+		}
+		uri = c.String()
+	}
+	dialer, err := shadowsocks.NewDialer(uri)
+	if err != nil {
+		return nil, err
+	}
+	dialer.UDPOverTCP = udpOverTCP
+	return dialer, nil
+}
+
+// newRouter returns the router of the route file, everything goes through the dialer without it
+func newRouter(dialer *shadowsocks.Dialer) (*shadowsocks.Router, error) {
+	if routeFile == "" {
+		return shadowsocks.NewRouter(dialer), nil
+	}
+	return shadowsocks.LoadRouter(routeFile, dialer)
 }
@@ -90,8 +90,22 @@ func putBytes(p BytesPool, d []byte) {
 	}
 }
 
+// base64Encodings are the encodings accepted in the userinfo, SIP002 uses base64url with optional padding
+var base64Encodings = []*base64.Encoding{
+	base64.StdEncoding,
+	base64.URLEncoding,
+	base64.RawStdEncoding,
+	base64.RawURLEncoding,
+}
+
 func decodeCipherAndPasswordFromBase64(str string) (cipher, password string, err error) {
-	data, err := base64.StdEncoding.DecodeString(str)
+	var data []byte
+	for _, enc := range base64Encodings {
+		data, err = enc.DecodeString(str)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
 		return "", "", fmt.Errorf("can't support %q", str)
 	}
@@ -0,0 +1,272 @@
+package shadowsocks
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	errTooManyConnections = errors.New("too many connections")
+	errTooManySessions    = errors.New("too many udp sessions")
+	errTooManyNew         = errors.New("too many new connections per second")
+)
+
+// Limits caps the connections and sessions, a zero is unlimited
+type Limits struct {
+	// Connections is the maximum of concurrent tcp connections
+	Connections int
+	// Sessions is the maximum of concurrent udp sessions
+	Sessions int
+	// Rate is the maximum of new tcp connections and udp sessions per second
+	Rate int
+}
+
+// Rejections counts the rejected connections and sessions by the scope of the limit
+type Rejections struct {
+	Global int64
+	IP     int64
+	User   int64
+}
+
+// ConnLimits caps the connections and sessions of the servers globally, per source ip and per user,
+// the limits can be changed at any time, the open connections over them are kept.
+// It can be shared by several servers, such as the Server and the PacketServer on a port.
+type ConnLimits struct {
+	// rejections is first to be aligned for the atomic operations
+	rejections Rejections
+
+	mut      sync.Mutex
+	global   Limits
+	ip       Limits
+	user     Limits
+	users    map[string]Limits
+	counters [3]map[string]*limitCounter // by scope and key
+}
+
+// NewConnLimits creates a new ConnLimits without limits
+func NewConnLimits() *ConnLimits {
+	return &ConnLimits{
+		users: map[string]Limits{},
+		counters: [3]map[string]*limitCounter{
+			{}, {}, {},
+		},
+	}
+}
+
+type limitScope int
+
+const (
+	scopeGlobal limitScope = iota
+	scopeIP
+	scopeUser
+)
+
+// limitCounter counts the connections and sessions of a scope and key
+type limitCounter struct {
+	conns    int
+	sessions int
+	rate     *Limiter
+}
+
+// SetGlobal sets the limits of all the connections together
+func (c *ConnLimits) SetGlobal(limits Limits) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.global = limits
+	c.update(scopeGlobal, "", limits)
+}
+
+// SetPerIP sets the limits of the connections from each source ip
+func (c *ConnLimits) SetPerIP(limits Limits) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.ip = limits
+	for key := range c.counters[scopeIP] {
+		c.update(scopeIP, key, limits)
+	}
+}
+
+// SetPerUser sets the limits of the connections of each user without limits of their own
+func (c *ConnLimits) SetPerUser(limits Limits) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.user = limits
+	for key := range c.counters[scopeUser] {
+		if _, ok := c.users[key]; !ok {
+			c.update(scopeUser, key, limits)
+		}
+	}
+}
+
+// SetUser sets the limits of the connections of the user
+func (c *ConnLimits) SetUser(name string, limits Limits) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.users[name] = limits
+	c.update(scopeUser, name, limits)
+}
+
+// DeleteUser removes the limits of the user, the ones of SetPerUser apply again
+func (c *ConnLimits) DeleteUser(name string) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	delete(c.users, name)
+	c.update(scopeUser, name, c.user)
+}
+
+// Rejections returns the count of the rejected connections and sessions
+func (c *ConnLimits) Rejections() Rejections {
+	return Rejections{
+		Global: atomic.LoadInt64(&c.rejections.Global),
+		IP:     atomic.LoadInt64(&c.rejections.IP),
+		User:   atomic.LoadInt64(&c.rejections.User),
+	}
+}
+
+// update applies the limits to the rate of the counter, if any
+func (c *ConnLimits) update(scope limitScope, key string, limits Limits) {
+	if counter, ok := c.counters[scope][key]; ok {
+		counter.rate.SetLimit(int64(limits.Rate), 0)
+	}
+}
+
+func (c *ConnLimits) limits(scope limitScope, key string) Limits {
+	switch scope {
+	case scopeGlobal:
+		return c.global
+	case scopeIP:
+		return c.ip
+	}
+	if limits, ok := c.users[key]; ok {
+		return limits
+	}
+	return c.user
+}
+
+// admit admits a new connection or session of the client, a nil ConnLimits admits everything
+func (c *ConnLimits) admit(network string, client net.Addr) (*admission, error) {
+	if c == nil {
+		return nil, nil
+	}
+	a := &admission{
+		limits:  c,
+		network: network,
+	}
+	err := a.acquire(scopeGlobal, "")
+	if err != nil {
+		return nil, err
+	}
+	host := client.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	err = a.acquire(scopeIP, host)
+	if err != nil {
+		a.release()
+		return nil, err
+	}
+	return a, nil
+}
+
+// admission is the limit counters holding an admitted connection or session
+type admission struct {
+	limits   *ConnLimits
+	network  string
+	acquired []acquired
+}
+
+type acquired struct {
+	scope limitScope
+	key   string
+}
+
+// admitUser admits the connection or session for the user once authenticated
+func (a *admission) admitUser(user *User) error {
+	if a == nil || user == nil {
+		return nil
+	}
+	return a.acquire(scopeUser, user.Name)
+}
+
+func (a *admission) acquire(scope limitScope, key string) error {
+	c := a.limits
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	limits := c.limits(scope, key)
+	counter, ok := c.counters[scope][key]
+	if !ok {
+		counter = &limitCounter{
+			rate: NewLimiter(int64(limits.Rate), 0),
+		}
+		c.counters[scope][key] = counter
+	}
+	var err error
+	if a.network == "udp" {
+		if limits.Sessions > 0 && counter.sessions >= limits.Sessions {
+			err = errTooManySessions
+		}
+	} else if limits.Connections > 0 && counter.conns >= limits.Connections {
+		err = errTooManyConnections
+	}
+	if err == nil && !counter.rate.allow(1) {
+		err = errTooManyNew
+	}
+	if err != nil {
+		c.forget(scope, key, counter)
+		return c.reject(scope, key, err)
+	}
+	if a.network == "udp" {
+		counter.sessions++
+	} else {
+		counter.conns++
+	}
+	a.acquired = append(a.acquired, acquired{scope: scope, key: key})
+	return nil
+}
+
+// reject counts the rejection and returns its error, the user is left to userError
+func (c *ConnLimits) reject(scope limitScope, key string, err error) error {
+	switch scope {
+	case scopeGlobal:
+		atomic.AddInt64(&c.rejections.Global, 1)
+		return err
+	case scopeIP:
+		atomic.AddInt64(&c.rejections.IP, 1)
+		return fmt.Errorf("ip %s: %w", key, err)
+	}
+	atomic.AddInt64(&c.rejections.User, 1)
+	return err
+}
+
+// forget removes the counter once nothing is counted, the global one is kept
+func (c *ConnLimits) forget(scope limitScope, key string, counter *limitCounter) {
+	if scope != scopeGlobal && counter.conns == 0 && counter.sessions == 0 && counter.rate.full() {
+		delete(c.counters[scope], key)
+	}
+}
+
+// release releases the counters of the connection or session
+func (a *admission) release() {
+	if a == nil {
+		return
+	}
+	c := a.limits
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, acq := range a.acquired {
+		counter, ok := c.counters[acq.scope][acq.key]
+		if !ok {
+			continue
+		}
+		if a.network == "udp" {
+			counter.sessions--
+		} else {
+			counter.conns--
+		}
+		c.forget(acq.scope, acq.key, counter)
+	}
+	a.acquired = nil
+}
@@ -0,0 +1,274 @@
+package shadowsocks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// The modes of the servers of a configuration file
+const (
+	// ModeTCPOnly relays tcp, it is the default
+	ModeTCPOnly = "tcp_only"
+	// ModeUDPOnly relays udp
+	ModeUDPOnly = "udp_only"
+	// ModeTCPAndUDP relays tcp and udp
+	ModeTCPAndUDP = "tcp_and_udp"
+)
+
+// FileConfig is a JSON configuration file of shadowsocks-libev and shadowsocks-rust,
+// such as
+//
+//	{
+//		"server": "0.0.0.0",
+//		"server_port": 8388,
+//		"password": "barfoo!",
+//		"method": "chacha20-ietf-poly1305",
+//		"timeout": 300,
+//		"mode": "tcp_and_udp"
+//	}
+//
+// The servers are given by server_port and password, by port_password for several ports instead,
+// or by the servers array of shadowsocks-rust, whose entries default to the top level fields.
+type FileConfig struct {
+	// Server is the host of the servers, or several hosts
+	Server Hosts `json:"server"`
+	// ServerPort is the port of the server
+	ServerPort Number `json:"server_port"`
+	// LocalAddress is the host of a local proxy
+	LocalAddress string `json:"local_address"`
+	// LocalPort is the port of a local proxy
+	LocalPort Number `json:"local_port"`
+	// Password use password authentication
+	Password string `json:"password"`
+	// Method use cipher protocol
+	Method string `json:"method"`
+	// Timeout is the idle timeout in seconds
+	Timeout Number `json:"timeout"`
+	// Mode is tcp_only, udp_only or tcp_and_udp, the default is tcp_only
+	Mode string `json:"mode"`
+	// Plugin is the SIP003 plugin executable
+	Plugin string `json:"plugin"`
+	// PluginOpts is passed to the plugin in SS_PLUGIN_OPTIONS
+	PluginOpts string `json:"plugin_opts"`
+	// PortPassword is the password of each port, for several servers
+	PortPassword map[string]string `json:"port_password"`
+	// Servers are the servers of shadowsocks-rust
+	Servers []*FileServer `json:"servers"`
+}
+
+// FileServer is an entry of the servers of a FileConfig, the empty fields default to the top level ones
+type FileServer struct {
+	// Server is the host of the server
+	Server string `json:"server"`
+	// ServerPort is the port of the server
+	ServerPort Number `json:"server_port"`
+	// Password use password authentication
+	Password string `json:"password"`
+	// Method use cipher protocol
+	Method string `json:"method"`
+	// Timeout is the idle timeout in seconds
+	Timeout Number `json:"timeout"`
+	// Mode is tcp_only, udp_only or tcp_and_udp
+	Mode string `json:"mode"`
+	// Plugin is the SIP003 plugin executable
+	Plugin string `json:"plugin"`
+	// PluginOpts is passed to the plugin in SS_PLUGIN_OPTIONS
+	PluginOpts string `json:"plugin_opts"`
+	// Remarks is the tag of the server
+	Remarks string `json:"remarks"`
+}
+
+// Hosts is a host or a list of hosts, as the server field of shadowsocks-libev
+type Hosts []string
+
+// UnmarshalJSON reads a string or an array of strings
+func (h *Hosts) UnmarshalJSON(b []byte) error {
+	var host string
+	if json.Unmarshal(b, &host) == nil {
+		*h = Hosts{host}
+		return nil
+	}
+	var hosts []string
+	err := json.Unmarshal(b, &hosts)
+	if err != nil {
+		return fmt.Errorf("server: want a host or a list of hosts")
+	}
+	*h = hosts
+	return nil
+}
+
+// Number is a number or a string of a number, as the ports and the timeout of shadowsocks-libev
+type Number int
+
+// UnmarshalJSON reads a number or a string of a number
+func (n *Number) UnmarshalJSON(b []byte) error {
+	var i int
+	if json.Unmarshal(b, &i) == nil {
+		*n = Number(i)
+		return nil
+	}
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err == nil {
+		i, err = strconv.Atoi(s)
+	}
+	if err != nil {
+		return fmt.Errorf("want a number, got %s", b)
+	}
+	*n = Number(i)
+	return nil
+}
+
+// LoadFileConfig reads a JSON configuration file
+func LoadFileConfig(file string) (*FileConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := ParseFileConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return c, nil
+}
+
+// ParseFileConfig reads a JSON configuration, the unknown fields are ignored
+func ParseFileConfig(r io.Reader) (*FileConfig, error) {
+	c := &FileConfig{}
+	err := json.NewDecoder(r).Decode(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ServerConfig is a server of a FileConfig
+type ServerConfig struct {
+	Config
+	// Mode is tcp_only, udp_only or tcp_and_udp
+	Mode string
+	// Timeout is the idle timeout, zero for the default
+	Timeout time.Duration
+}
+
+// TCP reports whether the server relays tcp
+func (s *ServerConfig) TCP() bool {
+	return s.Mode != ModeUDPOnly
+}
+
+// UDP reports whether the server relays udp
+func (s *ServerConfig) UDP() bool {
+	return s.Mode != ModeTCPOnly
+}
+
+// ServerConfigs returns the servers of the file, from server_port, port_password and servers in this order,
+// one for each host of a server with several hosts
+func (c *FileConfig) ServerConfigs() ([]*ServerConfig, error) {
+	var servers []*ServerConfig
+	add := func(host string, port int, s *FileServer) error {
+		if port <= 0 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+		if s.Password == "" {
+			s.Password = c.Password
+		}
+		if s.Method == "" {
+			s.Method = c.Method
+		}
+		if s.Timeout == 0 {
+			s.Timeout = c.Timeout
+		}
+		if s.Mode == "" {
+			s.Mode = c.Mode
+		}
+		if s.Plugin == "" {
+			s.Plugin, s.PluginOpts = c.Plugin, c.PluginOpts
+		}
+		switch s.Mode {
+		case "":
+			s.Mode = ModeTCPOnly
+		case ModeTCPOnly, ModeUDPOnly, ModeTCPAndUDP:
+		default:
+			return fmt.Errorf("unknown mode %q", s.Mode)
+		}
+		if s.Method == "" {
+			return fmt.Errorf("port %d: the method is required", port)
+		}
+		servers = append(servers, &ServerConfig{
+			Config: Config{
+				Cipher:        s.Method,
+				Password:      s.Password,
+				Address:       net.JoinHostPort(host, strconv.Itoa(port)),
+				Plugin:        s.Plugin,
+				PluginOptions: s.PluginOpts,
+				Tag:           s.Remarks,
+			},
+			Mode:    s.Mode,
+			Timeout: time.Duration(s.Timeout) * time.Second,
+		})
+		return nil
+	}
+
+	hosts := c.Server
+	if len(hosts) == 0 {
+		// all the interfaces
+		hosts = Hosts{""}
+	}
+	if c.ServerPort != 0 && len(c.PortPassword) == 0 {
+		for _, host := range hosts {
+			err := add(host, int(c.ServerPort), &FileServer{})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	ports := make([]int, 0, len(c.PortPassword))
+	passwords := make(map[int]string, len(c.PortPassword))
+	for port, password := range c.PortPassword {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, fmt.Errorf("port_password: invalid port %q", port)
+		}
+		ports = append(ports, p)
+		passwords[p] = password
+	}
+	sort.Ints(ports)
+	for _, port := range ports {
+		for _, host := range hosts {
+			err := add(host, port, &FileServer{Password: passwords[port]})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, s := range c.Servers {
+		s := *s
+		host := s.Server
+		if host == "" && len(c.Server) != 0 {
+			host = c.Server[0]
+		}
+		err := add(host, int(s.ServerPort), &s)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no server configured")
+	}
+	return servers, nil
+}
+
+// LocalAddr returns the address of a local proxy, empty without a local port
+func (c *FileConfig) LocalAddr() string {
+	if c.LocalPort == 0 {
+		return ""
+	}
+	return net.JoinHostPort(c.LocalAddress, strconv.Itoa(int(c.LocalPort)))
+}
@@ -4,5 +4,7 @@ go 1.15
 
 require (
 	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
 	golang.org/x/crypto v0.35.0
+	lukechampine.com/blake3 v1.1.7
 )
@@ -0,0 +1,22 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+)
+
+// Handler serves the decrypted connections accepted by a Server
+type Handler interface {
+	// ServeStream serves the conn of the client asking for the target,
+	// user is the matched user, nil when the server has no users.
+	// The conn is closed by the server when ServeStream returns.
+	ServeStream(ctx context.Context, user *User, client, target net.Addr, conn net.Conn) error
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as Handler
+type HandlerFunc func(ctx context.Context, user *User, client, target net.Addr, conn net.Conn) error
+
+// ServeStream calls f(ctx, user, client, target, conn)
+func (f HandlerFunc) ServeStream(ctx context.Context, user *User, client, target net.Addr, conn net.Conn) error {
+	return f(ctx, user, client, target, conn)
+}
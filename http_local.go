@@ -0,0 +1,225 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// hopHeaders are the hop-by-hop headers, they are not forwarded
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPLocal is a local HTTP proxy forwarding the CONNECT tunnels and
+// the requests with an absolute URI through a shadowsocks server.
+type HTTPLocal struct {
+	// ProxyDial specifies the optional dial function for
+	// the connections to the targets, usually the DialContext of a Dialer.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// Logger error log
+	Logger Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool BytesPool
+	Listener  net.Listener
+	Network   string
+	Address   string
+
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// NewHTTPLocal creates a new HTTPLocal listening on the address and forwarding through the dialer
+func NewHTTPLocal(addr string, d *Dialer) *HTTPLocal {
+	return &HTTPLocal{
+		ProxyDial: d.DialContext,
+		Network:   "tcp",
+		Address:   addr,
+	}
+}
+
+// Run the HTTPLocal
+func (l *HTTPLocal) Run(ctx context.Context) error {
+	err := l.listen(ctx)
+	if err != nil {
+		return err
+	}
+	return l.Serve(l.Listener)
+}
+
+// Start the HTTPLocal
+func (l *HTTPLocal) Start(ctx context.Context) error {
+	err := l.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go l.Serve(l.Listener)
+	return nil
+}
+
+func (l *HTTPLocal) listen(ctx context.Context) error {
+	if l.Listener == nil {
+		var listenConfig net.ListenConfig
+		listener, err := listenConfig.Listen(ctx, l.Network, l.Address)
+		if err != nil {
+			return err
+		}
+		l.Listener = listener
+	}
+	l.Address = l.Listener.Addr().String()
+	return nil
+}
+
+// Close closes the listener
+func (l *HTTPLocal) Close() error {
+	if l.Listener == nil {
+		return nil
+	}
+	return l.Listener.Close()
+}
+
+// Serve is used to serve connections from a listener
+func (l *HTTPLocal) Serve(listener net.Listener) error {
+	srv := &http.Server{
+		Handler: l,
+	}
+	return srv.Serve(listener)
+}
+
+// ServeHTTP serves a proxy request
+func (l *HTTPLocal) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var err error
+	if r.Method == http.MethodConnect {
+		err = l.connect(w, r)
+	} else if r.URL.IsAbs() {
+		err = l.forward(w, r)
+	} else {
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+	}
+	if err != nil && l.Logger != nil && !isClosedConnError(err) {
+		l.Logger.Println(fmt.Errorf("http %s %s: %w", r.Method, r.Host, err))
+	}
+}
+
+// connect tunnels the connection to the host
+func (l *HTTPLocal) connect(w http.ResponseWriter, r *http.Request) error {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return fmt.Errorf("hijacking not supported")
+	}
+	ctx := l.context()
+	target, err := l.proxyDial(ctx, "tcp", r.Host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		target.Close()
+		return err
+	}
+	_, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		target.Close()
+		return err
+	}
+	// what the client sent after the request is already buffered
+	if n := rw.Reader.Buffered(); n > 0 {
+		b, _ := rw.Reader.Peek(n)
+		_, err = target.Write(b)
+		if err != nil {
+			conn.Close()
+			target.Close()
+			return err
+		}
+	}
+
+	buf1 := getBytes(l.BytesPool)
+	buf2 := getBytes(l.BytesPool)
+	defer func() {
+		putBytes(l.BytesPool, buf1)
+		putBytes(l.BytesPool, buf2)
+	}()
+	return tunnel(ctx, target, conn, buf1, buf2)
+}
+
+// forward sends the request with an absolute URI and copies back the response
+func (l *HTTPLocal) forward(w http.ResponseWriter, r *http.Request) error {
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	removeHopHeaders(req.Header)
+
+	resp, err := l.roundTripper().RoundTrip(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	header := w.Header()
+	for k, v := range resp.Header {
+		header[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	buf := getBytes(l.BytesPool)
+	defer putBytes(l.BytesPool, buf)
+	_, err = io.CopyBuffer(w, resp.Body, buf)
+	return err
+}
+
+func (l *HTTPLocal) roundTripper() http.RoundTripper {
+	l.transportOnce.Do(func() {
+		l.transport = &http.Transport{
+			DialContext: l.proxyDial,
+		}
+	})
+	return l.transport
+}
+
+// removeHopHeaders removes the hop-by-hop headers and those named in the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, v := range header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				header.Del(k)
+			}
+		}
+	}
+	for _, k := range hopHeaders {
+		header.Del(k)
+	}
+}
+
+func (l *HTTPLocal) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyDial := l.ProxyDial
+	if proxyDial == nil {
+		var dialer net.Dialer
+		proxyDial = dialer.DialContext
+	}
+	return proxyDial(ctx, network, address)
+}
+
+func (l *HTTPLocal) context() context.Context {
+	if l.Context == nil {
+		return context.Background()
+	}
+	return l.Context
+}
@@ -3,6 +3,8 @@ package init
 import (
 	_ "github.com/wzshiming/shadowsocks/aead/aes-x-gcm"
 	_ "github.com/wzshiming/shadowsocks/aead/chacha20-ietf-poly1305"
+	_ "github.com/wzshiming/shadowsocks/aead2022/blake3-aes-x-gcm"
+	_ "github.com/wzshiming/shadowsocks/aead2022/blake3-chacha20-poly1305"
 	_ "github.com/wzshiming/shadowsocks/dummy"
 	_ "github.com/wzshiming/shadowsocks/stream/aes-x-cfb"
 	_ "github.com/wzshiming/shadowsocks/stream/aes-x-ctr"
@@ -0,0 +1,123 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// Listener accepts the decrypted connections of a shadowsocks server, leaving dialing the targets to the caller
+type Listener struct {
+	server   *Server
+	listener net.Listener
+	conns    chan *TargetConn
+	closed   chan struct{}
+	err      error
+}
+
+// NewListener returns a Listener accepting the connections from l, they are
+// authenticated and decrypted as configured in s, whose Handler is not used
+func NewListener(l net.Listener, s *Server) *Listener {
+	listener := &Listener{
+		server:   s,
+		listener: l,
+		conns:    make(chan *TargetConn),
+		closed:   make(chan struct{}),
+	}
+	go listener.serve()
+	return listener
+}
+
+func (l *Listener) serve() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			l.err = err
+			close(l.closed)
+			return
+		}
+		go l.serveConn(conn)
+	}
+}
+
+func (l *Listener) serveConn(conn net.Conn) {
+	defer conn.Close()
+	s := l.server
+	err := s.serveConn(conn, l)
+	if err != nil && s.Logger != nil && !isClosedConnError(err) {
+		s.Logger.Println(err)
+	}
+}
+
+// ServeStream hands the conn to Accept and waits for it to be closed,
+// the udp over tcp relay is still served by the server
+func (l *Listener) ServeStream(ctx context.Context, user *User, client, target net.Addr, conn net.Conn) error {
+	addr, err := toAddress(target)
+	if err != nil {
+		return err
+	}
+	if l.server.UDPOverTCP && isUDPOverTCPAddress(addr) {
+		return l.server.serveUDPOverTCP(ctx, conn, addr)
+	}
+	c := &TargetConn{
+		Conn:   conn,
+		target: addr,
+		user:   user,
+		done:   make(chan struct{}),
+	}
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		return nil
+	}
+	<-c.done
+	return nil
+}
+
+// Accept waits for and returns the next connection, it is a *TargetConn
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+// Close closes the listener, the accepted connections are not closed
+func (l *Listener) Close() error {
+	return l.listener.Close()
+}
+
+// Addr returns the listener's network address
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// TargetConn is a decrypted connection whose target address has been read
+type TargetConn struct {
+	net.Conn
+	target    *address
+	user      *User
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Target returns the address the client asks to connect to
+func (c *TargetConn) Target() string {
+	return c.target.String()
+}
+
+// User returns the matched user, nil when the server has no users
+func (c *TargetConn) User() *User {
+	return c.user
+}
+
+// Close closes the connection
+func (c *TargetConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return err
+}
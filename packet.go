@@ -10,21 +10,42 @@ type ListenPacket interface {
 	ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error)
 }
 
-func decryptPacket(c ConnCipher, p BytesPool, dist, src []byte) (n int, addr net.Addr, err error) {
+// PacketSession encrypts and decrypts the packets of a udp session,
+// a ConnCipher is a PacketSession without state.
+type PacketSession interface {
+	Decrypt(dist, src []byte) (n int, err error)
+	Encrypt(dist, src []byte) (n int, err error)
+}
+
+// PacketCipher is implemented by the ciphers whose udp packets belong to sessions,
+// the packet client and server use it instead of the ConnCipher.
+type PacketCipher interface {
+	// NewPacketSession starts a client session
+	NewPacketSession() (PacketSession, error)
+	// OpenPacket decrypts a client packet and returns the server session it belongs to
+	OpenPacket(dist, src []byte) (n int, sess PacketSession, err error)
+}
+
+func decryptPacket(c PacketSession, p BytesPool, dist, src []byte) (n int, addr net.Addr, err error) {
 	i, err := c.Decrypt(dist, src)
 	if err != nil {
 		return 0, nil, err
 	}
-	buf := bytes.NewBuffer(dist[:i])
+	return splitPacketAddress(dist[:i])
+}
+
+// splitPacketAddress reads the address in front of the packet and moves the payload to the beginning
+func splitPacketAddress(b []byte) (n int, addr net.Addr, err error) {
+	buf := bytes.NewBuffer(b)
 	a, err := readAddress(buf)
 	if err != nil {
 		return 0, nil, err
 	}
-	i = copy(dist, buf.Bytes())
-	return i, a, nil
+	n = copy(b, buf.Bytes())
+	return n, a, nil
 }
 
-func encryptPacket(c ConnCipher, p BytesPool, dist, src []byte, addr net.Addr) (n int, err error) {
+func encryptPacket(c PacketSession, p BytesPool, dist, src []byte, addr net.Addr) (n int, err error) {
 	a, err := parseAddress(addr.String())
 	if err != nil {
 		return 0, err
@@ -44,11 +65,26 @@ func encryptPacket(c ConnCipher, p BytesPool, dist, src []byte, addr net.Addr) (
 	return i, nil
 }
 
+// toPacketAddr returns the udp address of an ip, a domain name is kept to be resolved by the proxy server
+func toPacketAddr(addr *address) net.Addr {
+	if addr.IP == nil {
+		return addr
+	}
+	return &net.UDPAddr{
+		IP:   addr.IP,
+		Port: addr.Port,
+	}
+}
+
 func toUDPAddr(addr net.Addr) (net.Addr, error) {
 	switch a := addr.(type) {
 	case *net.UDPAddr:
 		return addr, nil
 	case *address:
+		if a.IP == nil {
+			// a domain name is resolved
+			return net.ResolveUDPAddr("udp", a.String())
+		}
 		return &net.UDPAddr{
 			IP:   a.IP,
 			Port: a.Port,
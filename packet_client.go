@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"net/url"
 )
 
 type PacketClient struct {
@@ -30,35 +29,17 @@ type PacketClient struct {
 }
 
 func NewPacketClient(addr string) (*PacketClient, error) {
-	d := &PacketClient{
-		ProxyNetwork: "udp",
-	}
-	u, err := url.Parse(addr)
+	c, cipher, err := parseEndpoint(addr)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "ss", "shadowsocks":
-	default:
-		return nil, fmt.Errorf("unsupported protocol '%s'", u.Scheme)
-	}
-	host := u.Host
-	port := u.Port()
-	if port == "" {
-		port = "8379"
-		hostname := u.Hostname()
-		host = net.JoinHostPort(hostname, port)
-	}
-	if u.User != nil {
-		d.Cipher = u.User.Username()
-		d.Password, _ = u.User.Password()
-	}
-	d.ProxyAddress = host
-	cipher, err := NewCipher(d.Cipher, d.Password)
-	if err != nil {
-		return nil, err
+	d := &PacketClient{
+		ProxyNetwork: "udp",
+		ProxyAddress: c.Address,
+		Cipher:       c.Cipher,
+		Password:     c.Password,
+		ConnCipher:   cipher,
 	}
-	d.ConnCipher = cipher
 	return d, nil
 }
 
@@ -76,13 +57,20 @@ func (l *PacketClient) ListenPacket(ctx context.Context, network, address string
 	if err != nil {
 		return nil, err
 	}
+	var encryptor PacketSession = l.ConnCipher
+	if c, ok := l.ConnCipher.(PacketCipher); ok {
+		encryptor, err = c.NewPacketSession()
+		if err != nil {
+			return nil, err
+		}
+	}
 	conn, err := l.proxyListenPacket(ctx, network, address)
 	if err != nil {
 		return nil, err
 	}
 	conn = &packetClient{
 		PacketConn: conn,
-		Encryptor:  l.ConnCipher,
+		Encryptor:  encryptor,
 		BytesPool:  l.BytesPool,
 		Peer:       udpAddr,
 	}
@@ -91,7 +79,7 @@ func (l *PacketClient) ListenPacket(ctx context.Context, network, address string
 
 type packetClient struct {
 	net.PacketConn
-	Encryptor ConnCipher
+	Encryptor PacketSession
 	BytesPool BytesPool
 	Peer      net.Addr
 }
@@ -25,6 +25,10 @@ type PacketServer struct {
 	Password string
 	// ConnCipher is connect the cipher codec
 	ConnCipher ConnCipher
+	// Users is the user table, when set each packet is matched to a user,
+	// by the ConnCipher if it is a UserCipher, otherwise by trying the users' ciphers in order,
+	// which must then be AEAD ciphers if there are several users
+	Users []*User
 	// IsResolve resolve domain name on locally
 	IsResolve bool
 	// Resolver optionally specifies an alternate resolver to use
@@ -36,14 +40,31 @@ type PacketServer struct {
 	Logger Logger
 	// BytesPool getting and returning temporary bytes
 	BytesPool BytesPool
+	// ACL optionally restricts the targets, the denied packets are dropped,
+	// DefaultACL denies the local networks
+	ACL *ACL
+	// Traffic optionally counts the traffic of the udp sessions
+	Traffic *TrafficStats
+	// RateLimiter optionally limits the bandwidth of the udp sessions, the packets over it are dropped
+	RateLimiter *RateLimiter
+	// ConnLimits optionally caps the udp sessions, the packets of the rejected ones are logged and dropped
+	ConnLimits *ConnLimits
 
 	connTableMut sync.Mutex
 	connTable    map[string]*session
+	sessions     int
+	inShutdown   bool
+	packetConns  map[net.PacketConn]struct{}
 }
 
 type session struct {
-	last time.Time
-	conn net.PacketConn
+	last      time.Time
+	conn      net.PacketConn
+	encryptor PacketSession
+	user      *User
+	traffic   *connTraffic
+	limiter   *connLimiter
+	admission *admission
 }
 
 func NewPacketServer() *PacketServer {
@@ -65,23 +86,38 @@ func (p *PacketServer) ListenAndServe(network, addr string) error {
 }
 
 func (p *PacketServer) ServePacket(conn net.PacketConn) error {
+	if !p.trackPacketConn(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer p.trackPacketConn(conn, false)
 	ps := &packetServer{
 		PacketConn: conn,
 		BytesPool:  p.BytesPool,
-		Encryptor:  p.ConnCipher,
+		Settings:   p.Settings,
 	}
 	ctx, cancel := context.WithCancel(p.context())
 	defer cancel()
 	go p.gcTask(ctx)
 	for {
 		buf := getBytes(p.BytesPool)
-		i, src, dest, err := ps.readFrom(buf[:])
+		i, wire, src, dest, encryptor, user, err := ps.readFrom(buf[:])
 		if err != nil {
+			putBytes(p.BytesPool, buf)
+			if _, ok := err.(*badPacketError); ok {
+				if p.Logger != nil {
+					p.Logger.Println(err)
+				}
+				continue
+			}
+			if p.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go func() {
 			defer putBytes(p.BytesPool, buf)
-			p.forward(ps, src, dest, buf[:i])
+			p.forward(ctx, ps, src, dest, encryptor, user, buf[:i], wire)
 		}()
 	}
 }
@@ -123,49 +159,121 @@ func (p *PacketServer) proxyListenPacket(ctx context.Context, network, address s
 	return proxyPacket(ctx, network, address)
 }
 
-func (p *PacketServer) forward(conn *packetServer, src, dest net.Addr, buf []byte) {
-	sess, err := p.session(conn, src, dest)
+// forward sends a packet of the client to its target, it checks the target with the ACL
+// and resolves it apart from the read loop, which a slow lookup would hold for all the clients
+func (p *PacketServer) forward(ctx context.Context, conn *packetServer, src, dest net.Addr, encryptor PacketSession, user *User, buf []byte, wire int) {
+	checked, err := p.Settings().ACL.check(ctx, dest)
+	if err == nil {
+		dest, err = toUDPAddr(checked)
+	}
 	if err != nil {
+		// the denied packets are dropped
 		if p.Logger != nil {
-			p.Logger.Println(err)
+			p.Logger.Println(&badPacketError{from: src, err: userError(user, err)})
 		}
 		return
 	}
+	sess, err := p.session(conn, src, dest, encryptor, user)
+	if err != nil {
+		if p.Logger != nil {
+			p.Logger.Println(userError(user, err))
+		}
+		return
+	}
+	if !sess.limiter.allow(len(buf), uploadLimiter) {
+		return
+	}
 	_, err = sess.conn.WriteTo(buf, dest)
 	if err != nil {
 		if p.Logger != nil {
-			p.Logger.Println(err)
+			p.Logger.Println(userError(user, err))
 		}
+		return
 	}
+	sess.traffic.add(Traffic{Upload: int64(len(buf)), UploadWire: int64(wire)})
 
 }
 
-func (p *PacketServer) session(conn *packetServer, src, dest net.Addr) (*session, error) {
+func (p *PacketServer) session(conn *packetServer, src, dest net.Addr, encryptor PacketSession, user *User) (*session, error) {
 	key := strings.Join([]string{src.String(), dest.String()}, "|")
 
 	p.connTableMut.Lock()
 	sess, ok := p.connTable[key]
 	if ok {
 		sess.last = time.Now()
+		sess.encryptor = encryptor
 		p.connTableMut.Unlock()
 		return sess, nil
 	}
+	if p.inShutdown {
+		p.connTableMut.Unlock()
+		return nil, ErrServerClosed
+	}
 	p.connTableMut.Unlock()
 
-	forward, err := p.proxyListenPacket(p.context(), p.ProxyNetwork, ":0")
+	settings := p.Settings()
+	admission, err := settings.ConnLimits.admit("udp", src)
+	if err != nil {
+		return nil, fmt.Errorf("reject %s: %w", src, err)
+	}
+	err = admission.admitUser(user)
+	if err != nil {
+		admission.release()
+		return nil, fmt.Errorf("reject %s: %w", src, err)
+	}
+
+	ctx := p.context()
+	if user != nil {
+		ctx = ContextWithUser(ctx, user)
+	}
+	forward, err := p.proxyListenPacket(ctx, p.ProxyNetwork, ":0")
 	if err != nil {
+		admission.release()
 		return nil, err
 	}
 
+	p.connTableMut.Lock()
+	if p.inShutdown {
+		p.connTableMut.Unlock()
+		forward.Close()
+		admission.release()
+		return nil, ErrServerClosed
+	}
+	if other, ok := p.connTable[key]; ok {
+		// another packet of the client created the session meanwhile
+		other.last = time.Now()
+		other.encryptor = encryptor
+		p.connTableMut.Unlock()
+		forward.Close()
+		admission.release()
+		return other, nil
+	}
 	sess = &session{
-		last: time.Now(),
-		conn: forward,
+		last:      time.Now(),
+		conn:      forward,
+		encryptor: encryptor,
+		user:      user,
+		traffic:   p.Traffic.open("udp", src),
+		limiter:   settings.RateLimiter.open(user),
+		admission: admission,
+	}
+	if p.connTable == nil {
+		p.connTable = map[string]*session{}
 	}
-	p.connTableMut.Lock()
 	p.connTable[key] = sess
+	p.sessions++
 	p.connTableMut.Unlock()
+	sess.traffic.identify(user, dest)
 
 	go func() {
+		defer func() {
+			p.connTableMut.Lock()
+			p.sessions--
+			p.connTableMut.Unlock()
+			sess.traffic.close()
+			sess.limiter.close()
+			sess.admission.release()
+		}()
 		key := dest.String()
 		buf := getBytes(p.BytesPool)
 		defer putBytes(p.BytesPool, buf)
@@ -173,20 +281,27 @@ func (p *PacketServer) session(conn *packetServer, src, dest net.Addr) (*session
 			n, addr, err := forward.ReadFrom(buf[:])
 			if err != nil {
 				if p.Logger != nil {
-					p.Logger.Println(err)
+					p.Logger.Println(userError(user, err))
 				}
 				return
 			}
 			if addr.String() != key {
 				continue
 			}
-			_, err = conn.writeTo(buf[:n], dest, src)
+			if !sess.limiter.allow(n, downloadLimiter) {
+				continue
+			}
+			p.connTableMut.Lock()
+			encryptor := sess.encryptor
+			p.connTableMut.Unlock()
+			wire, err := conn.writeTo(encryptor, buf[:n], dest, src)
 			if err != nil {
 				if p.Logger != nil {
-					p.Logger.Println(err)
+					p.Logger.Println(userError(user, err))
 				}
 				return
 			}
+			sess.traffic.add(Traffic{Download: int64(n), DownloadWire: int64(wire)})
 		}
 	}()
 	return sess, nil
@@ -199,34 +314,55 @@ func (p *PacketServer) context() context.Context {
 	return p.Context
 }
 
+// badPacketError is returned for a packet that can't be decrypted, the server skips it
+type badPacketError struct {
+	from net.Addr
+	err  error
+}
+
+func (e *badPacketError) Error() string {
+	return fmt.Sprintf("from %v: %v", e.from, e.err)
+}
+
 type packetServer struct {
 	net.PacketConn
-	Encryptor ConnCipher
 	BytesPool BytesPool
+	// Settings returns the ciphers, the users and the ACL of each packet
+	Settings func() Settings
 }
 
-func (p *packetServer) readFrom(b []byte) (n int, ori, addr net.Addr, err error) {
+// readFrom reads and decrypts a packet and returns the session to encrypt the replies with,
+// the target is as the client sent it, wire is the size of the encrypted packet
+func (p *packetServer) readFrom(b []byte) (n, wire int, ori, addr net.Addr, encryptor PacketSession, user *User, err error) {
 	buf := getBytes(p.BytesPool)
 	defer putBytes(p.BytesPool, buf)
-	n, a, err := p.PacketConn.ReadFrom(buf)
+	wire, a, err := p.PacketConn.ReadFrom(buf)
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, 0, nil, nil, nil, nil, err
 	}
-	n, addr, err = decryptPacket(p.Encryptor, p.BytesPool, b, buf[:n])
-	if err != nil {
-		return 0, nil, nil, fmt.Errorf("from %v: %v", a, err)
+	settings := p.Settings()
+	if len(settings.Users) != 0 {
+		n, addr, encryptor, user, err = matchPacketUser(b, buf[:wire], settings.ConnCipher, settings.Users)
+	} else if c, ok := settings.ConnCipher.(PacketCipher); ok {
+		n, encryptor, err = c.OpenPacket(b, buf[:wire])
+		if err == nil {
+			n, addr, err = splitPacketAddress(b[:n])
+		}
+	} else {
+		encryptor = settings.ConnCipher
+		n, addr, err = decryptPacket(encryptor, p.BytesPool, b, buf[:wire])
 	}
-	addr, err = toUDPAddr(addr)
 	if err != nil {
-		return 0, nil, nil, err
+		return 0, 0, nil, nil, nil, nil, &badPacketError{from: a, err: err}
 	}
-	return n, a, addr, nil
+	return n, wire, a, addr, encryptor, user, nil
 }
 
-func (p *packetServer) writeTo(b []byte, ori, addr net.Addr) (n int, err error) {
+// writeTo encrypts and sends a packet, it returns the size of the encrypted packet
+func (p *packetServer) writeTo(encryptor PacketSession, b []byte, ori, addr net.Addr) (n int, err error) {
 	buf := getBytes(p.BytesPool)
 	defer putBytes(p.BytesPool, buf)
-	n, err = encryptPacket(p.Encryptor, p.BytesPool, buf, b, ori)
+	n, err = encryptPacket(encryptor, p.BytesPool, buf, b, ori)
 	if err != nil {
 		return 0, err
 	}
@@ -234,5 +370,5 @@ func (p *packetServer) writeTo(b []byte, ori, addr net.Addr) (n int, err error)
 	if err != nil {
 		return 0, err
 	}
-	return len(b), nil
+	return n, nil
 }
@@ -0,0 +1,227 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// pluginStartTimeout is the maximum amount of time to wait for a plugin to listen
+	pluginStartTimeout = 10 * time.Second
+	// pluginRestartDelay is the time to wait before restarting an exited plugin
+	pluginRestartDelay = time.Second
+)
+
+var errPluginClosed = errors.New("plugin closed")
+
+// Plugin is a SIP003 plugin process, it is restarted when it exits until closed
+type Plugin struct {
+	// Name is the plugin executable
+	Name string
+	// Options is passed to the plugin in SS_PLUGIN_OPTIONS
+	Options string
+	// RemoteAddress is the address of the server side, passed in SS_REMOTE_HOST and SS_REMOTE_PORT
+	RemoteAddress string
+	// LocalAddress is the address of the client side, passed in SS_LOCAL_HOST and SS_LOCAL_PORT
+	LocalAddress string
+	// Server runs the plugin in front of a server, it listens on the RemoteAddress instead of the LocalAddress
+	Server bool
+	// Logger error log
+	Logger Logger
+
+	mut    sync.Mutex
+	cmd    *exec.Cmd
+	closed bool
+	exited chan struct{}
+	// firstExit is closed when the first process exits, with its error in firstErr
+	firstExit chan struct{}
+	firstErr  error
+}
+
+// Start starts the plugin and waits until it listens
+func (p *Plugin) Start(ctx context.Context) error {
+	p.mut.Lock()
+	cmd, err := p.command()
+	if err != nil {
+		p.mut.Unlock()
+		return err
+	}
+	p.cmd = cmd
+	p.exited = make(chan struct{})
+	p.firstExit = make(chan struct{})
+	p.mut.Unlock()
+
+	go p.run(cmd)
+
+	err = p.wait(ctx)
+	if err != nil {
+		p.Close()
+		return err
+	}
+	return nil
+}
+
+// Close kills the plugin
+func (p *Plugin) Close() error {
+	p.mut.Lock()
+	if p.closed {
+		p.mut.Unlock()
+		return nil
+	}
+	p.closed = true
+	cmd := p.cmd
+	exited := p.exited
+	p.mut.Unlock()
+
+	if cmd == nil {
+		return nil
+	}
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+	<-exited
+	return nil
+}
+
+// Address returns the address the plugin listens on
+func (p *Plugin) Address() string {
+	if p.Server {
+		return p.RemoteAddress
+	}
+	return p.LocalAddress
+}
+
+func (p *Plugin) command() (*exec.Cmd, error) {
+	if p.closed {
+		return nil, errPluginClosed
+	}
+	remoteHost, remotePort, err := net.SplitHostPort(p.RemoteAddress)
+	if err != nil {
+		return nil, err
+	}
+	localHost, localPort, err := net.SplitHostPort(p.LocalAddress)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(p.Name)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+p.Options,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	return cmd, nil
+}
+
+// run restarts the plugin whenever it exits until closed
+func (p *Plugin) run(cmd *exec.Cmd) {
+	defer close(p.exited)
+	first := true
+	for {
+		err := cmd.Wait()
+		if first {
+			first = false
+			p.firstErr = err
+			close(p.firstExit)
+		}
+
+		p.mut.Lock()
+		closed := p.closed
+		p.mut.Unlock()
+		if closed {
+			return
+		}
+		if p.Logger != nil {
+			p.Logger.Println(fmt.Sprintf("plugin %s exited: %v, restarting", p.Name, err))
+		}
+
+		for {
+			time.Sleep(pluginRestartDelay)
+			p.mut.Lock()
+			cmd, err = p.command()
+			if err == nil {
+				p.cmd = cmd
+			}
+			p.mut.Unlock()
+			if err == nil {
+				break
+			}
+			if err == errPluginClosed {
+				return
+			}
+			if p.Logger != nil {
+				p.Logger.Println(fmt.Sprintf("plugin %s restart: %v", p.Name, err))
+			}
+		}
+	}
+}
+
+// wait waits until the plugin accepts connections, it fails as soon as the plugin exits
+func (p *Plugin) wait(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pluginStartTimeout)
+	defer cancel()
+	address := dialableAddress(p.Address())
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("plugin %s not ready on %s: %w", p.Name, address, err)
+		case <-p.firstExit:
+			return fmt.Errorf("plugin %s exited while starting: %v", p.Name, p.firstErr)
+		case <-tick.C:
+		}
+	}
+}
+
+// dialableAddress replaces the unspecified host of a listening address with the loopback
+func dialableAddress(address string) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// freeAddress returns the address with an unused port when the port is zero or missing
+func freeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if port != "" && port != "0" {
+		return address, nil
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	_, port, err = net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
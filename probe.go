@@ -0,0 +1,113 @@
+package shadowsocks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// ProbePolicy is how the server reacts to a connection failing authentication
+type ProbePolicy int
+
+const (
+	// ProbeClose closes the connection right away
+	ProbeClose ProbePolicy = iota
+	// ProbeDrain reads until a random number of bytes or the ProbeTimeout, then closes
+	ProbeDrain
+	// ProbeFallback forwards the connection with the bytes already read to the ProbeFallback address
+	ProbeFallback
+	// ProbeReset closes the connection with a TCP reset
+	ProbeReset
+)
+
+var probePolicyNames = map[ProbePolicy]string{
+	ProbeClose:    "close",
+	ProbeDrain:    "drain",
+	ProbeFallback: "fallback",
+	ProbeReset:    "reset",
+}
+
+func (p ProbePolicy) String() string {
+	if name, ok := probePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("ProbePolicy(%d)", int(p))
+}
+
+// ParseProbePolicy returns the policy of the name
+func ParseProbePolicy(name string) (ProbePolicy, error) {
+	for p, n := range probePolicyNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported probe policy %q", name)
+}
+
+const (
+	// probeMaxDrain is the maximum number of bytes drained
+	probeMaxDrain = 64 * 1024
+	// probeTimeout is the default time of the authentication and a drained connection is held
+	probeTimeout = time.Minute
+)
+
+func (s *Server) probeTimeout() time.Duration {
+	if s.ProbeTimeout == 0 {
+		return probeTimeout
+	}
+	return s.ProbeTimeout
+}
+
+// probe handles the conn that failed authentication with err,
+// either the data is not authenticated or the conn failed before, such as by the authentication deadline
+func (s *Server) probe(ctx context.Context, conn *peekConn, err error) error {
+	err = fmt.Errorf("authentication failed from %s: %w", conn.RemoteAddr(), err)
+	switch s.ProbePolicy {
+	case ProbeDrain:
+		conn.SetReadDeadline(time.Now().Add(s.probeTimeout()))
+		io.CopyN(ioutil.Discard, conn.Conn, drainSize())
+	case ProbeFallback:
+		if s.ProbeFallback == "" {
+			break
+		}
+		var dialer net.Dialer
+		fallback, e := dialer.DialContext(ctx, "tcp", s.ProbeFallback)
+		if e != nil {
+			return fmt.Errorf("%v, fallback: %w", err, e)
+		}
+		_, e = fallback.Write(conn.buf)
+		if e != nil {
+			fallback.Close()
+			return fmt.Errorf("%v, fallback: %w", err, e)
+		}
+		conn.buf = nil
+		conn.SetReadDeadline(time.Time{})
+		buf1 := getBytes(s.BytesPool)
+		buf2 := getBytes(s.BytesPool)
+		defer func() {
+			putBytes(s.BytesPool, buf1)
+			putBytes(s.BytesPool, buf2)
+		}()
+		tunnel(ctx, fallback, conn.Conn, buf1, buf2)
+	case ProbeReset:
+		if c, ok := conn.Conn.(interface{ SetLinger(int) error }); ok {
+			c.SetLinger(0)
+		}
+	}
+	return err
+}
+
+// drainSize returns a random number of bytes to drain
+func drainSize() int64 {
+	var b [4]byte
+	_, err := io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		return probeMaxDrain
+	}
+	return 1 + int64(binary.BigEndian.Uint32(b[:])%probeMaxDrain)
+}
@@ -0,0 +1,402 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket limiting a bandwidth, it can be adjusted while in use.
+// A nil Limiter or one with a zero rate is unlimited.
+type Limiter struct {
+	mut    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a new Limiter of rate bytes per second, up to burst bytes at once,
+// the burst defaults to the rate
+func NewLimiter(rate, burst int64) *Limiter {
+	l := &Limiter{}
+	l.SetLimit(rate, burst)
+	return l
+}
+
+// SetLimit changes the rate and the burst of the limiter
+func (l *Limiter) SetLimit(rate, burst int64) {
+	if burst <= 0 {
+		burst = rate
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+	l.advance(now)
+	if l.last.IsZero() || l.rate <= 0 {
+		// the bucket starts full
+		l.tokens = float64(burst)
+	}
+	l.rate = float64(rate)
+	l.burst = float64(burst)
+	l.last = now
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Limit returns the rate and the burst of the limiter
+func (l *Limiter) Limit() (rate, burst int64) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return int64(l.rate), int64(l.burst)
+}
+
+// advance fills the bucket for the time elapsed
+func (l *Limiter) advance(now time.Time) {
+	if l.last.IsZero() {
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// reserve takes n tokens, borrowing the missing ones, and returns how long to wait for them
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.advance(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// allow takes n tokens if there are enough
+func (l *Limiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if !l.available(time.Now(), n) {
+		return false
+	}
+	l.take(n)
+	return true
+}
+
+// available reports whether there are n tokens, the limiter is locked
+func (l *Limiter) available(now time.Time, n int) bool {
+	if l.rate <= 0 {
+		return true
+	}
+	l.advance(now)
+	return l.tokens >= float64(n)
+}
+
+// take takes n available tokens, the limiter is locked
+func (l *Limiter) take(n int) {
+	if l.rate > 0 {
+		l.tokens -= float64(n)
+	}
+}
+
+// full reports whether the bucket is full, as if the limiter was never used
+func (l *Limiter) full() bool {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.rate <= 0 {
+		return true
+	}
+	l.advance(time.Now())
+	return l.tokens >= l.burst
+}
+
+// Bandwidth is a rate in bytes per second with its burst, a zero rate is unlimited
+type Bandwidth struct {
+	// Rate is the bytes per second
+	Rate int64
+	// Burst is the bytes allowed at once, the default is the rate
+	Burst int64
+}
+
+// RateLimit is the upload and download bandwidths, the upload is from the clients and the download to them
+type RateLimit struct {
+	Upload   Bandwidth
+	Download Bandwidth
+}
+
+// limiters limits the upload and the download
+type limiters struct {
+	upload   *Limiter
+	download *Limiter
+}
+
+func newLimiters(r RateLimit) *limiters {
+	return &limiters{
+		upload:   NewLimiter(r.Upload.Rate, r.Upload.Burst),
+		download: NewLimiter(r.Download.Rate, r.Download.Burst),
+	}
+}
+
+func (l *limiters) set(r RateLimit) {
+	l.upload.SetLimit(r.Upload.Rate, r.Upload.Burst)
+	l.download.SetLimit(r.Download.Rate, r.Download.Burst)
+}
+
+// RateLimiter limits the bandwidth of the servers globally, per user and per connection,
+// the limits can be changed at any time and apply to the open connections.
+// It can be shared by several servers, such as the Server and the PacketServer on a port.
+// The tcp connections wait for the bandwidth, the udp packets over it are dropped.
+type RateLimiter struct {
+	mut          sync.Mutex
+	global       *limiters
+	user         RateLimit
+	users        map[string]RateLimit
+	userLimiters map[string]*limiters
+	// userConns counts the connections of the users with limiters
+	userConns map[string]int
+	// idleUsers are the users without connections whose limiters are kept until they are full
+	idleUsers map[string]struct{}
+	conn      RateLimit
+	conns     map[*limiters]struct{}
+}
+
+// NewRateLimiter creates a new RateLimiter without limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		global:       newLimiters(RateLimit{}),
+		users:        map[string]RateLimit{},
+		userLimiters: map[string]*limiters{},
+		userConns:    map[string]int{},
+		idleUsers:    map[string]struct{}{},
+		conns:        map[*limiters]struct{}{},
+	}
+}
+
+// SetGlobal sets the limit shared by all the connections
+func (r *RateLimiter) SetGlobal(limit RateLimit) {
+	r.global.set(limit)
+}
+
+// SetUsers sets the limit shared by the connections of each user without a limit of their own
+func (r *RateLimiter) SetUsers(limit RateLimit) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.user = limit
+	for name, l := range r.userLimiters {
+		if _, ok := r.users[name]; !ok {
+			l.set(limit)
+		}
+	}
+}
+
+// SetUser sets the limit shared by the connections of the user
+func (r *RateLimiter) SetUser(name string, limit RateLimit) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.users[name] = limit
+	if l, ok := r.userLimiters[name]; ok {
+		l.set(limit)
+	}
+}
+
+// DeleteUser removes the limit of the user, the one of SetUsers applies again
+func (r *RateLimiter) DeleteUser(name string) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.users, name)
+	if l, ok := r.userLimiters[name]; ok {
+		l.set(r.user)
+	}
+}
+
+// SetConnection sets the limit of each tcp connection and udp session
+func (r *RateLimiter) SetConnection(limit RateLimit) {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.conn = limit
+	for l := range r.conns {
+		l.set(limit)
+	}
+}
+
+// open returns the limiters of a connection of the user, a nil RateLimiter limits nothing
+func (r *RateLimiter) open(user *User) *connLimiter {
+	if r == nil {
+		return nil
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	c := &connLimiter{
+		limiter: r,
+		conn:    newLimiters(r.conn),
+		global:  r.global,
+	}
+	r.conns[c.conn] = struct{}{}
+	if user != nil {
+		l, ok := r.userLimiters[user.Name]
+		if !ok {
+			limit, ok := r.users[user.Name]
+			if !ok {
+				limit = r.user
+			}
+			l = newLimiters(limit)
+			r.userLimiters[user.Name] = l
+		}
+		c.user = l
+		c.userName = user.Name
+		r.userConns[user.Name]++
+		delete(r.idleUsers, user.Name)
+	}
+	r.forgetIdleUsers()
+	return c
+}
+
+// forgetIdleUsers removes the limiters of the users without connections once they are full,
+// removing them before would forgive the bandwidth the users borrowed
+func (r *RateLimiter) forgetIdleUsers() {
+	for name := range r.idleUsers {
+		l := r.userLimiters[name]
+		if l.upload.full() && l.download.full() {
+			delete(r.userLimiters, name)
+			delete(r.idleUsers, name)
+		}
+	}
+}
+
+// connLimiter is the limiters applying to a connection
+type connLimiter struct {
+	limiter  *RateLimiter
+	conn     *limiters
+	user     *limiters
+	userName string
+	global   *limiters
+}
+
+func (c *connLimiter) close() {
+	if c == nil {
+		return
+	}
+	r := c.limiter
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	delete(r.conns, c.conn)
+	if c.user != nil {
+		r.userConns[c.userName]--
+		if r.userConns[c.userName] == 0 {
+			delete(r.userConns, c.userName)
+			r.idleUsers[c.userName] = struct{}{}
+		}
+	}
+	r.forgetIdleUsers()
+}
+
+// wait takes n tokens from the limiters selected by fn and waits for them, unless done is closed
+func (c *connLimiter) wait(done <-chan struct{}, n int, fn func(*limiters) *Limiter) bool {
+	var d time.Duration
+	for _, l := range []*limiters{c.conn, c.user, c.global} {
+		if l == nil {
+			continue
+		}
+		if w := fn(l).reserve(n); w > d {
+			d = w
+		}
+	}
+	if d == 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// allow takes n tokens from the limiters selected by fn if they all have enough, otherwise none
+func (c *connLimiter) allow(n int, fn func(*limiters) *Limiter) bool {
+	if c == nil {
+		return true
+	}
+	selected := make([]*Limiter, 0, 3)
+	for _, l := range []*limiters{c.conn, c.user, c.global} {
+		if l != nil {
+			selected = append(selected, fn(l))
+		}
+	}
+	// all the connections lock the limiters in the same order
+	for _, l := range selected {
+		l.mut.Lock()
+		defer l.mut.Unlock()
+	}
+	now := time.Now()
+	for _, l := range selected {
+		if !l.available(now, n) {
+			return false
+		}
+	}
+	for _, l := range selected {
+		l.take(n)
+	}
+	return true
+}
+
+func uploadLimiter(l *limiters) *Limiter {
+	return l.upload
+}
+
+func downloadLimiter(l *limiters) *Limiter {
+	return l.download
+}
+
+// limitConn waits for the bandwidth of the data read and written
+type limitConn struct {
+	net.Conn
+	limiter   *connLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLimitConn(conn net.Conn, limiter *connLimiter) *limitConn {
+	return &limitConn{
+		Conn:    conn,
+		limiter: limiter,
+		done:    make(chan struct{}),
+	}
+}
+
+func (c *limitConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.limiter.wait(c.done, n, uploadLimiter) {
+		return n, errClosedConn
+	}
+	return n, err
+}
+
+func (c *limitConn) Write(b []byte) (int, error) {
+	if !c.limiter.wait(c.done, len(b), downloadLimiter) {
+		return 0, errClosedConn
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *limitConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,317 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// RedirMode is how the connections are redirected to a Redir
+type RedirMode int
+
+const (
+	// RedirRedirect is for the tcp connections redirected by the REDIRECT target,
+	// the original destination is read from SO_ORIGINAL_DST
+	RedirRedirect RedirMode = iota
+	// RedirTProxy is for the tcp connections and udp packets redirected by the TPROXY target,
+	// the original destination is the local address of the socket
+	RedirTProxy
+)
+
+// TransparentPacketConn is a packet conn receiving the udp packets redirected by TPROXY
+type TransparentPacketConn interface {
+	net.PacketConn
+	// ReadFromOriginal reads a packet with its source and original destination,
+	// an error other than the conn being closed only drops the packet
+	ReadFromOriginal(b []byte) (n int, from, to net.Addr, err error)
+	// ListenOriginal returns a packet conn sending from the original destination
+	ListenOriginal(to net.Addr) (net.PacketConn, error)
+}
+
+// Redir is a transparent proxy forwarding the connections and packets redirected by
+// iptables or nftables through a shadowsocks server to their original destination, as ss-redir does.
+type Redir struct {
+	// ProxyDial specifies the optional dial function for
+	// the tcp connections, usually the DialContext of a Dialer.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the optional listen function for
+	// the udp packets, usually the ListenPacket of a Dialer.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+	// Mode is how the connections are redirected, udp needs RedirTProxy
+	Mode RedirMode
+	// OriginalDestination optionally specifies how to recover the original destination of a connection,
+	// the default depends on the Mode
+	OriginalDestination func(conn net.Conn) (net.Addr, error)
+	// Timeout is the idle time after which a udp session is closed, the default is one minute
+	Timeout time.Duration
+	// Logger error log
+	Logger Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool  BytesPool
+	Listener   net.Listener
+	PacketConn TransparentPacketConn
+	Address    string
+
+	sessionsMut sync.Mutex
+	sessions    map[string]net.PacketConn
+}
+
+// NewRedir creates a new Redir listening on the address and forwarding through the dialer
+func NewRedir(addr string, mode RedirMode, d *Dialer) *Redir {
+	return &Redir{
+		ProxyDial:   d.DialContext,
+		ProxyPacket: d.ListenPacket,
+		Mode:        mode,
+		Address:     addr,
+	}
+}
+
+// Run the Redir, it returns when either the tcp or the udp side fails
+func (r *Redir) Run(ctx context.Context) error {
+	err := r.listen(ctx)
+	if err != nil {
+		return err
+	}
+	if r.PacketConn == nil {
+		return r.Serve(r.Listener)
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- r.Serve(r.Listener)
+	}()
+	go func() {
+		errCh <- r.ServePacket(r.PacketConn)
+	}()
+	return <-errCh
+}
+
+// Start the Redir
+func (r *Redir) Start(ctx context.Context) error {
+	err := r.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go r.Serve(r.Listener)
+	if r.PacketConn != nil {
+		go r.ServePacket(r.PacketConn)
+	}
+	return nil
+}
+
+// listen listens for tcp, and for udp on the same address in RedirTProxy mode
+func (r *Redir) listen(ctx context.Context) error {
+	if r.Listener == nil {
+		var listener net.Listener
+		var err error
+		if r.Mode == RedirTProxy {
+			listener, err = ListenTransparent(ctx, "tcp", r.Address)
+		} else {
+			var listenConfig net.ListenConfig
+			listener, err = listenConfig.Listen(ctx, "tcp", r.Address)
+		}
+		if err != nil {
+			return err
+		}
+		r.Listener = listener
+	}
+	r.Address = r.Listener.Addr().String()
+	if r.PacketConn == nil && r.Mode == RedirTProxy {
+		packetConn, err := ListenTransparentPacket(ctx, "udp", r.Address)
+		if err != nil {
+			r.Listener.Close()
+			return err
+		}
+		r.PacketConn = packetConn
+	}
+	return nil
+}
+
+// Close closes the listener and the packet conn
+func (r *Redir) Close() error {
+	var err error
+	if r.Listener != nil {
+		err = r.Listener.Close()
+	}
+	if r.PacketConn != nil {
+		e := r.PacketConn.Close()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Serve is used to serve connections from a listener
+func (r *Redir) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go r.ServeConn(conn)
+	}
+}
+
+// ServeConn is used to serve a single connection.
+func (r *Redir) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	err := r.serveConn(conn)
+	if err != nil && r.Logger != nil && !isClosedConnError(err) {
+		r.Logger.Println(err)
+	}
+}
+
+func (r *Redir) serveConn(conn net.Conn) error {
+	dst, err := r.originalDestination(conn)
+	if err != nil {
+		return fmt.Errorf("original destination of %s: %w", conn.RemoteAddr(), err)
+	}
+	ctx := r.context()
+	target, err := r.proxyDial(ctx, "tcp", dst.String())
+	if err != nil {
+		return err
+	}
+	buf1 := getBytes(r.BytesPool)
+	buf2 := getBytes(r.BytesPool)
+	defer func() {
+		putBytes(r.BytesPool, buf1)
+		putBytes(r.BytesPool, buf2)
+	}()
+	return tunnel(ctx, target, conn, buf1, buf2)
+}
+
+func (r *Redir) originalDestination(conn net.Conn) (net.Addr, error) {
+	if r.OriginalDestination != nil {
+		return r.OriginalDestination(conn)
+	}
+	if r.Mode == RedirTProxy {
+		return conn.LocalAddr(), nil
+	}
+	return OriginalDestination(conn)
+}
+
+// ServePacket forwards the packets of each client and original destination in its own session,
+// the replies are sent from the original destination.
+func (r *Redir) ServePacket(conn TransparentPacketConn) error {
+	buf := getBytes(r.BytesPool)
+	defer putBytes(r.BytesPool, buf)
+	for {
+		n, from, to, err := conn.ReadFromOriginal(buf)
+		if err != nil {
+			if isClosedConnError(err) {
+				return err
+			}
+			if r.Logger != nil {
+				r.Logger.Println(fmt.Errorf("udp redir: %w", err))
+			}
+			continue
+		}
+		sess, err := r.session(conn, from, to)
+		if err != nil {
+			if r.Logger != nil {
+				r.Logger.Println(err)
+			}
+			continue
+		}
+		sess.SetReadDeadline(time.Now().Add(r.timeout()))
+		_, err = sess.WriteTo(buf[:n], to)
+		if err != nil && r.Logger != nil {
+			r.Logger.Println(fmt.Errorf("udp redir to %s: %w", to, err))
+		}
+	}
+}
+
+// session returns the packet conn relaying the packets from the client to the destination
+func (r *Redir) session(conn TransparentPacketConn, from, to net.Addr) (net.PacketConn, error) {
+	key := from.String() + "|" + to.String()
+	r.sessionsMut.Lock()
+	sess, ok := r.sessions[key]
+	r.sessionsMut.Unlock()
+	if ok {
+		return sess, nil
+	}
+	// the proxy may be dialed, such as for udp over tcp, without holding the other sessions
+	sess, err := r.proxyListenPacket(r.context(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	r.sessionsMut.Lock()
+	if other, ok := r.sessions[key]; ok {
+		// another packet of the client created the session meanwhile
+		r.sessionsMut.Unlock()
+		sess.Close()
+		return other, nil
+	}
+	// the reply conn is bound to the original destination, once per session
+	reply, err := conn.ListenOriginal(to)
+	if err != nil {
+		r.sessionsMut.Unlock()
+		sess.Close()
+		return nil, err
+	}
+	if r.sessions == nil {
+		r.sessions = map[string]net.PacketConn{}
+	}
+	r.sessions[key] = sess
+	r.sessionsMut.Unlock()
+
+	go func() {
+		defer func() {
+			r.sessionsMut.Lock()
+			delete(r.sessions, key)
+			r.sessionsMut.Unlock()
+			sess.Close()
+			reply.Close()
+		}()
+		buf := getBytes(r.BytesPool)
+		defer putBytes(r.BytesPool, buf)
+		for {
+			// the session ends when idle for the timeout
+			n, _, err := sess.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, err = reply.WriteTo(buf[:n], from)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return sess, nil
+}
+
+func (r *Redir) timeout() time.Duration {
+	if r.Timeout == 0 {
+		return time.Minute
+	}
+	return r.Timeout
+}
+
+func (r *Redir) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyDial := r.ProxyDial
+	if proxyDial == nil {
+		var dialer net.Dialer
+		proxyDial = dialer.DialContext
+	}
+	return proxyDial(ctx, network, address)
+}
+
+func (r *Redir) proxyListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	proxyPacket := r.ProxyPacket
+	if proxyPacket == nil {
+		var listenConfig net.ListenConfig
+		proxyPacket = listenConfig.ListenPacket
+	}
+	return proxyPacket(ctx, network, address)
+}
+
+func (r *Redir) context() context.Context {
+	if r.Context == nil {
+		return context.Background()
+	}
+	return r.Context
+}
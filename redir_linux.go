@@ -0,0 +1,174 @@
+//go:build linux
+// +build linux
+
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST for ipv6
+	soOriginalDst = 80
+	// ipv6RecvOrigDstAddr is IPV6_RECVORIGDSTADDR, and IPV6_ORIGDSTADDR of the control messages
+	ipv6RecvOrigDstAddr = 74
+	// ipv6Transparent is IPV6_TRANSPARENT
+	ipv6Transparent = 75
+)
+
+var errNoOriginalDestination = errors.New("no original destination")
+
+// OriginalDestination returns the original destination of a connection redirected by the REDIRECT target
+func OriginalDestination(conn net.Conn) (net.Addr, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil, errNoOriginalDestination
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	ipv4 := true
+	if a, ok := conn.LocalAddr().(*net.TCPAddr); ok && a.IP.To4() == nil {
+		ipv4 = false
+	}
+	var addr *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if ipv4 {
+			// the sockaddr_in fits in the ipv6_mreq
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			b := mreq.Multiaddr
+			addr = &net.TCPAddr{
+				IP:   net.IPv4(b[4], b[5], b[6], b[7]),
+				Port: int(b[2])<<8 | int(b[3]),
+			}
+		} else {
+			// the sockaddr_in6 fits in the ip6_mtuinfo
+			info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+			addr = &net.TCPAddr{
+				IP:   append(net.IP(nil), info.Addr.Addr[:]...),
+				Port: int(port[0])<<8 | int(port[1]),
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, sockErr
+	}
+	return addr, nil
+}
+
+// ListenTransparent listens for the tcp connections redirected by the TPROXY target
+func ListenTransparent(ctx context.Context, network, address string) (net.Listener, error) {
+	listenConfig := net.ListenConfig{
+		Control: transparentControl(false, false),
+	}
+	return listenConfig.Listen(ctx, network, address)
+}
+
+// ListenTransparentPacket listens for the udp packets redirected by the TPROXY target
+func ListenTransparentPacket(ctx context.Context, network, address string) (TransparentPacketConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: transparentControl(true, false),
+	}
+	conn, err := listenConfig.ListenPacket(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &transparentPacketConn{UDPConn: conn.(*net.UDPConn)}, nil
+}
+
+// transparentControl sets the socket options of the transparent sockets,
+// both the ipv4 and ipv6 ones are tried as the socket may be dual-stack.
+func transparentControl(recvOrigDst, reuseAddr bool) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setsockoptEither(int(fd), syscall.IP_TRANSPARENT, ipv6Transparent)
+			if sockErr != nil {
+				return
+			}
+			if recvOrigDst {
+				sockErr = setsockoptEither(int(fd), syscall.IP_RECVORIGDSTADDR, ipv6RecvOrigDstAddr)
+				if sockErr != nil {
+					return
+				}
+			}
+			if reuseAddr {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setsockoptEither enables the ipv4 and the ipv6 option, it fails only if both fail
+func setsockoptEither(fd, opt4, opt6 int) error {
+	err4 := syscall.SetsockoptInt(fd, syscall.SOL_IP, opt4, 1)
+	err6 := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, opt6, 1)
+	if err4 != nil && err6 != nil {
+		return err4
+	}
+	return nil
+}
+
+// transparentPacketConn reads the original destination from the IP_ORIGDSTADDR control messages
+type transparentPacketConn struct {
+	*net.UDPConn
+}
+
+func (c *transparentPacketConn) ReadFromOriginal(b []byte) (int, net.Addr, net.Addr, error) {
+	var oob [128]byte
+	n, oobn, _, from, err := c.ReadMsgUDP(b, oob[:])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	for _, msg := range msgs {
+		data := msg.Data
+		switch {
+		case msg.Header.Level == syscall.SOL_IP && msg.Header.Type == syscall.IP_ORIGDSTADDR && len(data) >= 8:
+			to := &net.UDPAddr{
+				IP:   net.IPv4(data[4], data[5], data[6], data[7]),
+				Port: int(data[2])<<8 | int(data[3]),
+			}
+			return n, from, to, nil
+		case msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(data) >= 24:
+			to := &net.UDPAddr{
+				IP:   append(net.IP(nil), data[8:24]...),
+				Port: int(data[2])<<8 | int(data[3]),
+			}
+			return n, from, to, nil
+		}
+	}
+	return 0, nil, nil, errNoOriginalDestination
+}
+
+func (c *transparentPacketConn) ListenOriginal(to net.Addr) (net.PacketConn, error) {
+	listenConfig := net.ListenConfig{
+		Control: transparentControl(false, true),
+	}
+	return listenConfig.ListenPacket(context.Background(), "udp", to.String())
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+// +build !linux
+
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+
+// OriginalDestination returns the original destination of a connection redirected by the REDIRECT target
+func OriginalDestination(conn net.Conn) (net.Addr, error) {
+	return nil, errTransparentNotSupported
+}
+
+// ListenTransparent listens for the tcp connections redirected by the TPROXY target
+func ListenTransparent(ctx context.Context, network, address string) (net.Listener, error) {
+	return nil, errTransparentNotSupported
+}
+
+// ListenTransparentPacket listens for the udp packets redirected by the TPROXY target
+func ListenTransparentPacket(ctx context.Context, network, address string) (TransparentPacketConn, error) {
+	return nil, errTransparentNotSupported
+}
@@ -0,0 +1,178 @@
+package shadowsocks
+
+import (
+	"net"
+)
+
+// Settings is the configuration of a Server or a PacketServer that can be reloaded while serving,
+// the new connections and udp sessions use it while the open ones go on.
+type Settings struct {
+	// Cipher use cipher protocol
+	Cipher string
+	// Password use password authentication
+	Password string
+	// ConnCipher is connect the cipher codec, the default is made from the cipher and the password,
+	// and made again when a reload changes them
+	ConnCipher ConnCipher
+	// Users is the user table, see the Users of the Server
+	Users []*User
+	// ACL optionally restricts the targets
+	ACL *ACL
+	// RateLimiter optionally limits the bandwidth
+	RateLimiter *RateLimiter
+	// ConnLimits optionally caps the connections and the udp sessions
+	ConnLimits *ConnLimits
+}
+
+// connCipher makes the ConnCipher from the cipher and the password when it is not set,
+// or when it is the current one while the cipher or the password changed
+func (c *Settings) connCipher(current *Settings) error {
+	if c.Cipher == "" {
+		return nil
+	}
+	if c.ConnCipher != nil {
+		if current == nil || c.ConnCipher != current.ConnCipher {
+			return nil
+		}
+		if c.Cipher == current.Cipher && c.Password == current.Password {
+			return nil
+		}
+	}
+	connCipher, err := NewCipher(c.Cipher, c.Password)
+	if err != nil {
+		return err
+	}
+	c.ConnCipher = connCipher
+	return nil
+}
+
+// removedUsers returns the names of the users missing from the new ones
+func removedUsers(old, users []*User) map[string]struct{} {
+	names := map[string]struct{}{}
+	for _, user := range old {
+		names[user.Name] = struct{}{}
+	}
+	for _, user := range users {
+		delete(names, user.Name)
+	}
+	return names
+}
+
+// Settings returns the current reloadable configuration of the server
+func (s *Server) Settings() Settings {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return Settings{
+		Cipher:      s.Cipher,
+		Password:    s.Password,
+		ConnCipher:  s.ConnCipher,
+		Users:       s.Users,
+		ACL:         s.ACL,
+		RateLimiter: s.RateLimiter,
+		ConnLimits:  s.ConnLimits,
+	}
+}
+
+// Reload replaces the configuration of the server while serving, the open connections go on,
+// except those of the users removed from the user table when closeRemoved is set.
+// Once serving, the fields of Settings are only to be changed by Reload.
+func (s *Server) Reload(settings Settings, closeRemoved bool) error {
+	current := s.Settings()
+	err := settings.connCipher(&current)
+	if err != nil {
+		return err
+	}
+	err = checkUsers(settings.Users)
+	if err != nil {
+		return err
+	}
+	s.mut.Lock()
+	removed := removedUsers(s.Users, settings.Users)
+	s.Cipher = settings.Cipher
+	s.Password = settings.Password
+	s.ConnCipher = settings.ConnCipher
+	s.Users = settings.Users
+	s.ACL = settings.ACL
+	s.RateLimiter = settings.RateLimiter
+	s.ConnLimits = settings.ConnLimits
+	var conns []net.Conn
+	if closeRemoved {
+		for conn, user := range s.conns {
+			if user == nil {
+				continue
+			}
+			if _, ok := removed[user.Name]; ok {
+				conns = append(conns, conn)
+			}
+		}
+	}
+	s.mut.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	return nil
+}
+
+// identifyConn records the user of a connection being served
+func (s *Server) identifyConn(conn net.Conn, user *User) {
+	if user == nil {
+		return
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = user
+	}
+}
+
+// Settings returns the current reloadable configuration of the server
+func (p *PacketServer) Settings() Settings {
+	p.connTableMut.Lock()
+	defer p.connTableMut.Unlock()
+	return Settings{
+		Cipher:      p.Cipher,
+		Password:    p.Password,
+		ConnCipher:  p.ConnCipher,
+		Users:       p.Users,
+		ACL:         p.ACL,
+		RateLimiter: p.RateLimiter,
+		ConnLimits:  p.ConnLimits,
+	}
+}
+
+// Reload replaces the configuration of the server while serving, the open udp sessions go on,
+// except those of the users removed from the user table when closeRemoved is set.
+// Once serving, the fields of Settings are only to be changed by Reload.
+func (p *PacketServer) Reload(settings Settings, closeRemoved bool) error {
+	current := p.Settings()
+	err := settings.connCipher(&current)
+	if err != nil {
+		return err
+	}
+	err = checkUsers(settings.Users)
+	if err != nil {
+		return err
+	}
+	p.connTableMut.Lock()
+	defer p.connTableMut.Unlock()
+	removed := removedUsers(p.Users, settings.Users)
+	p.Cipher = settings.Cipher
+	p.Password = settings.Password
+	p.ConnCipher = settings.ConnCipher
+	p.Users = settings.Users
+	p.ACL = settings.ACL
+	p.RateLimiter = settings.RateLimiter
+	p.ConnLimits = settings.ConnLimits
+	if closeRemoved {
+		for k, sess := range p.connTable {
+			if sess.user == nil {
+				continue
+			}
+			if _, ok := removed[sess.user.Name]; ok {
+				sess.conn.Close()
+				delete(p.connTable, k)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	errRouteBlocked = errors.New("blocked by route")
+	errClosedConn   = errors.New("use of closed network connection")
+)
+
+// Route is where a connection is routed to
+type Route int
+
+const (
+	// RouteProxy routes through the shadowsocks server
+	RouteProxy Route = iota
+	// RouteDirect routes directly to the target
+	RouteDirect
+	// RouteBlock refuses the connection
+	RouteBlock
+)
+
+// RouterRule applies its route to the addresses matching its conditions
+type RouterRule struct {
+	// Route is applied to the matching addresses
+	Route Route
+	Conditions
+}
+
+// Router routes the connections and packets through the proxy, directly or blocks them by rules,
+// the first matching rule applies. It can be the ProxyDial and ProxyPacket of the local frontends.
+type Router struct {
+	// ProxyDial specifies the dial function of RouteProxy, usually the DialContext of a Dialer.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the listen function of RouteProxy, usually the ListenPacket of a Dialer.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+	// DirectDial specifies the optional dial function of RouteDirect
+	DirectDial func(context.Context, string, string) (net.Conn, error)
+	// DirectPacket specifies the optional listen function of RouteDirect
+	DirectPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+	// Rules are tried in order
+	Rules []*RouterRule
+	// Default is the route when no rule matches
+	Default Route
+	// Resolve resolves the domain names for the rules on networks,
+	// otherwise those rules never match a domain name
+	Resolve bool
+	// Resolver optionally specifies an alternate resolver to use
+	Resolver *net.Resolver
+}
+
+// NewRouter creates a new Router without rules, proxying through the dialer,
+// without a dialer the proxy functions are left to be set
+func NewRouter(d *Dialer) *Router {
+	if d == nil {
+		return &Router{}
+	}
+	return &Router{
+		ProxyDial:   d.DialContext,
+		ProxyPacket: d.ListenPacket,
+	}
+}
+
+// LoadRouter reads the rules of a Router proxying through the dialer from the file,
+// the list files are relative to the directory of the file
+func LoadRouter(file string, d *Dialer) (*Router, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := parseRouter(f, filepath.Dir(file), d)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return r, nil
+}
+
+// ParseRouter reads the rules of a Router proxying through the dialer, in the format described by ParseACL
+// with the proxy, direct and block actions, such as
+//
+//	block domain-keyword ads
+//	direct domain-file direct_domains.txt
+//	direct cidr-file china_ip_list.txt
+//	direct cidr 192.168.0.0/16
+//	default proxy
+//	resolve
+func ParseRouter(r io.Reader, d *Dialer) (*Router, error) {
+	return parseRouter(r, "", d)
+}
+
+func parseRouter(r io.Reader, dir string, d *Dialer) (*Router, error) {
+	rs, err := parseRules(r, dir, parseRoute)
+	if err != nil {
+		return nil, fmt.Errorf("router %w", err)
+	}
+	router := NewRouter(d)
+	router.Default = Route(rs.def)
+	router.Resolve = rs.resolve
+	for _, r := range rs.rules {
+		router.Rules = append(router.Rules, &RouterRule{
+			Route:      Route(r.action),
+			Conditions: r.conditions,
+		})
+	}
+	return router, nil
+}
+
+func parseRoute(s string) (int, error) {
+	switch s {
+	case "proxy":
+		return int(RouteProxy), nil
+	case "direct":
+		return int(RouteDirect), nil
+	case "block":
+		return int(RouteBlock), nil
+	}
+	return 0, fmt.Errorf("unknown route %q", s)
+}
+
+// Match returns the route of the target address, host:port
+func (r *Router) Match(ctx context.Context, target string) (Route, error) {
+	addr, err := parseAddress(target)
+	if err != nil {
+		return 0, err
+	}
+	return r.match(ctx, addr)
+}
+
+func (r *Router) match(ctx context.Context, addr *address) (Route, error) {
+	i, _, err := firstMatch(ctx, addr, len(r.Rules), func(i int) *Conditions {
+		return &r.Rules[i].Conditions
+	}, r.Resolve, r.Resolver)
+	if err != nil {
+		return 0, fmt.Errorf("route %s: %w", addr, err)
+	}
+	if i == -1 {
+		return r.Default, nil
+	}
+	return r.Rules[i].Route, nil
+}
+
+// DialContext connects to the address on the named network by its route
+func (r *Router) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	route, err := r.Match(ctx, address)
+	if err != nil {
+		return nil, err
+	}
+	switch route {
+	case RouteProxy:
+		if r.ProxyDial == nil {
+			return nil, fmt.Errorf("route %s: no proxy", address)
+		}
+		return r.ProxyDial(ctx, network, address)
+	case RouteDirect:
+		return r.directDial(ctx, network, address)
+	}
+	return nil, fmt.Errorf("%s: %w", address, errRouteBlocked)
+}
+
+// Dial connects to the address on the named network by its route
+func (r *Router) Dial(network, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
+
+// ListenPacket returns a packet conn sending each packet by the route of its destination,
+// the packet conns of the routes are opened when first used
+func (r *Router) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	return &routerPacketConn{
+		router:  r,
+		ctx:     ctx,
+		network: network,
+		address: address,
+		packets: make(chan routerPacket),
+		closed:  make(chan struct{}),
+		changed: make(chan struct{}),
+	}, nil
+}
+
+func (r *Router) directDial(ctx context.Context, network, address string) (net.Conn, error) {
+	directDial := r.DirectDial
+	if directDial == nil {
+		var dialer net.Dialer
+		directDial = dialer.DialContext
+	}
+	return directDial(ctx, network, address)
+}
+
+func (r *Router) directPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	directPacket := r.DirectPacket
+	if directPacket == nil {
+		var listenConfig net.ListenConfig
+		directPacket = listenConfig.ListenPacket
+	}
+	return directPacket(ctx, network, address)
+}
+
+type routerPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+// routerPacketConn sends the packets through the packet conns of their routes and receives from all of them
+type routerPacketConn struct {
+	router  *Router
+	ctx     context.Context
+	network string
+	address string
+	packets chan routerPacket
+
+	mut       sync.Mutex
+	conns     [2]net.PacketConn // by RouteProxy and RouteDirect
+	deadline  time.Time
+	changed   chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *routerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mut.Lock()
+		deadline, changed := c.deadline, c.changed
+		c.mut.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			timeout = timer.C
+		}
+		var p routerPacket
+		var err error
+		retry := false
+		select {
+		case p = <-c.packets:
+		case <-c.closed:
+			err = &net.OpError{Op: "read", Net: c.network, Err: errClosedConn}
+		case <-timeout:
+			err = &net.OpError{Op: "read", Net: c.network, Err: os.ErrDeadlineExceeded}
+		case <-changed:
+			// wait again with the new deadline
+			retry = true
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if retry {
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		return copy(b, p.b), p.from, nil
+	}
+}
+
+func (c *routerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	a, err := toAddress(addr)
+	if err != nil {
+		return 0, err
+	}
+	route, err := c.router.match(c.ctx, a)
+	if err != nil {
+		return 0, err
+	}
+	if route == RouteBlock {
+		return 0, fmt.Errorf("%s: %w", addr, errRouteBlocked)
+	}
+	conn, err := c.conn(route)
+	if err != nil {
+		return 0, err
+	}
+	if route == RouteDirect {
+		addr, err = toUDPAddr(a)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return conn.WriteTo(b, addr)
+}
+
+// conn returns the packet conn of the route, opening it when first used
+func (c *routerPacketConn) conn(route Route) (net.PacketConn, error) {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	select {
+	case <-c.closed:
+		return nil, errClosedConn
+	default:
+	}
+	if conn := c.conns[route]; conn != nil {
+		return conn, nil
+	}
+	var conn net.PacketConn
+	var err error
+	if route == RouteProxy {
+		if c.router.ProxyPacket == nil {
+			return nil, fmt.Errorf("route %s: no proxy", c.address)
+		}
+		conn, err = c.router.ProxyPacket(c.ctx, c.network, c.address)
+	} else {
+		conn, err = c.router.directPacket(c.ctx, c.network, c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.conns[route] = conn
+	go c.receive(conn)
+	return conn, nil
+}
+
+func (c *routerPacketConn) receive(conn net.PacketConn) {
+	buf := make([]byte, maxUDPOverTCPPacket)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		select {
+		case c.packets <- routerPacket{b: b, from: from}:
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *routerPacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mut.Lock()
+		defer c.mut.Unlock()
+		close(c.closed)
+		for _, conn := range c.conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	})
+	return nil
+}
+
+func (c *routerPacketConn) LocalAddr() net.Addr {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	for _, conn := range c.conns {
+		if conn != nil {
+			return conn.LocalAddr()
+		}
+	}
+	return &net.UDPAddr{}
+}
+
+func (c *routerPacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *routerPacketConn) SetReadDeadline(t time.Time) error {
+	c.mut.Lock()
+	defer c.mut.Unlock()
+	c.deadline = t
+	close(c.changed)
+	c.changed = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, the packets are written without waiting
+func (c *routerPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,295 @@
+package shadowsocks
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Conditions match the addresses meeting all of them, an empty condition is ignored
+type Conditions struct {
+	// Networks matches the ip addresses in one of the networks,
+	// and the domain names resolving to one of them when the rules resolve
+	Networks []*net.IPNet
+	// DomainSuffixes matches the domain names equal to or under one of the suffixes
+	DomainSuffixes []string
+	// DomainKeywords matches the domain names containing one of the keywords
+	DomainKeywords []string
+	// DomainRegexps matches the domain names matching one of the expressions
+	DomainRegexps []*regexp.Regexp
+	// Ports matches the ports in one of the ranges
+	Ports []PortRange
+}
+
+// PortRange is an inclusive range of ports
+type PortRange struct {
+	From int
+	To   int
+}
+
+// rule is a parsed line of a rules file
+type rule struct {
+	action     int
+	conditions Conditions
+}
+
+// rules is a parsed rules file
+type rules struct {
+	rules   []rule
+	def     int
+	resolve bool
+}
+
+// parseRules reads the rules in the format described by ParseACL, the actions are parsed by parseAction,
+// the relative paths of the list files are relative to dir.
+func parseRules(r io.Reader, dir string, parseAction func(string) (int, error)) (*rules, error) {
+	rs := &rules{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		var err error
+		switch fields[0] {
+		case "resolve":
+			if len(fields) != 1 {
+				err = fmt.Errorf("unexpected %q", fields[1])
+			}
+			rs.resolve = true
+		case "default":
+			if len(fields) != 2 {
+				err = fmt.Errorf("want default and an action")
+			} else {
+				rs.def, err = parseAction(fields[1])
+			}
+		default:
+			var r rule
+			r.action, err = parseAction(fields[0])
+			if err == nil {
+				err = parseConditions(&r.conditions, fields[1:], dir)
+			}
+			if err == nil {
+				rs.rules = append(rs.rules, r)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return rs, nil
+}
+
+func parseConditions(c *Conditions, fields []string, dir string) error {
+	if len(fields) == 1 && fields[0] == "all" {
+		return nil
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("rule without conditions")
+	}
+	var cond string
+	for _, field := range fields {
+		switch field {
+		case "cidr", "cidr-file", "domain-suffix", "domain-file", "domain-keyword", "domain-regex", "port":
+			cond = field
+			continue
+		}
+		switch cond {
+		case "cidr":
+			_, network, err := net.ParseCIDR(field)
+			if err != nil {
+				return err
+			}
+			c.Networks = append(c.Networks, network)
+		case "cidr-file":
+			err := readList(filepath.Join(dir, field), func(s string) error {
+				_, network, err := net.ParseCIDR(s)
+				if err != nil {
+					return err
+				}
+				c.Networks = append(c.Networks, network)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		case "domain-suffix":
+			c.DomainSuffixes = append(c.DomainSuffixes, normalizeDomain(field))
+		case "domain-file":
+			err := readList(filepath.Join(dir, field), func(s string) error {
+				c.DomainSuffixes = append(c.DomainSuffixes, normalizeDomain(s))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		case "domain-keyword":
+			c.DomainKeywords = append(c.DomainKeywords, strings.ToLower(field))
+		case "domain-regex":
+			re, err := regexp.Compile(field)
+			if err != nil {
+				return err
+			}
+			c.DomainRegexps = append(c.DomainRegexps, re)
+		case "port":
+			ports, err := parsePortRange(field)
+			if err != nil {
+				return err
+			}
+			c.Ports = append(c.Ports, ports)
+		default:
+			return fmt.Errorf("unknown condition %q", field)
+		}
+	}
+	return nil
+}
+
+// readList calls fn with each entry of a list file, one per line, the blank and # lines are skipped
+func readList(file string, fn func(string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		err := fn(s)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func normalizeDomain(s string) string {
+	return strings.ToLower(strings.Trim(s, "."))
+}
+
+func parsePortRange(s string) (PortRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i != -1 {
+		from, to = s[:i], s[i+1:]
+	}
+	f, err := strconv.ParseUint(from, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	t, err := strconv.ParseUint(to, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+	if f > t {
+		return PortRange{}, fmt.Errorf("invalid port range %q", s)
+	}
+	return PortRange{From: int(f), To: int(t)}, nil
+}
+
+// firstMatch returns the index of the first of the n conditions matching the address, or -1,
+// the domain name is resolved once for the first condition on networks when resolve is set,
+// its ips are returned then. An address with both a name and an ip is matched as resolved to the ip.
+func firstMatch(ctx context.Context, addr *address, n int, conditions func(i int) *Conditions, resolve bool, resolver *net.Resolver) (int, []net.IP, error) {
+	name := normalizeDomain(addr.Name)
+	ips := []net.IP{addr.IP}
+	resolved := addr.IP != nil
+	var resolvedIPs []net.IP
+	for i := 0; i < n; i++ {
+		c := conditions(i)
+		if !c.matchPort(addr.Port) || !c.matchName(name) {
+			continue
+		}
+		if len(c.Networks) != 0 && !resolved {
+			if !resolve {
+				continue
+			}
+			if resolver == nil {
+				resolver = net.DefaultResolver
+			}
+			ipAddrs, err := resolver.LookupIPAddr(ctx, name)
+			if err != nil {
+				return 0, nil, err
+			}
+			ips = ips[:0]
+			for _, ipAddr := range ipAddrs {
+				ips = append(ips, ipAddr.IP)
+			}
+			resolved = true
+			resolvedIPs = ips
+		}
+		if !c.matchIPs(ips) {
+			continue
+		}
+		return i, resolvedIPs, nil
+	}
+	return -1, resolvedIPs, nil
+}
+
+func (c *Conditions) matchPort(port int) bool {
+	if len(c.Ports) == 0 {
+		return true
+	}
+	for _, ports := range c.Ports {
+		if port >= ports.From && port <= ports.To {
+			return true
+		}
+	}
+	return false
+}
+
+// matchName reports whether the conditions match the domain name, the ip addresses have no name
+func (c *Conditions) matchName(name string) bool {
+	if len(c.DomainSuffixes) == 0 && len(c.DomainKeywords) == 0 && len(c.DomainRegexps) == 0 {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, suffix := range c.DomainSuffixes {
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	for _, keyword := range c.DomainKeywords {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	for _, re := range c.DomainRegexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Conditions) matchIPs(ips []net.IP) bool {
+	if len(c.Networks) == 0 {
+		return true
+	}
+	for _, ip := range ips {
+		for _, network := range c.Networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package shadowsocks
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// ErrReplay is returned when a salt is seen again
+var ErrReplay = errors.New("salt replayed")
+
+// SaltFilter remembers the salts seen by a cipher to reject replayed connections and packets
+type SaltFilter interface {
+	// Add records a salt generated by ourselves
+	Add(salt []byte)
+	// Check reports whether the salt is new, and records it
+	Check(salt []byte) bool
+}
+
+var (
+	// SaltFilterCapacity is the number of salts each Bloom filter of the default SaltFilter holds
+	SaltFilterCapacity = 100000
+	// SaltFilterFalsePositiveRate is the false positive rate of the default SaltFilter
+	SaltFilterFalsePositiveRate = 1e-6
+)
+
+// NewSaltFilter creates the SaltFilter of the registered ciphers, set it to nil to disable salt checking
+var NewSaltFilter = func() SaltFilter {
+	return NewBloomRingFilter(SaltFilterCapacity, SaltFilterFalsePositiveRate)
+}
+
+// BloomRingFilter is a SaltFilter made of two rotating Bloom filters,
+// when the current one is full the older one is cleared and takes its place.
+type BloomRingFilter struct {
+	mut      sync.Mutex
+	capacity int
+	hashes   int
+	bits     uint64
+	filters  [2][]uint64
+	current  int
+	count    int
+}
+
+// NewBloomRingFilter creates a new BloomRingFilter, the memory is allocated on first use
+func NewBloomRingFilter(capacity int, falsePositiveRate float64) *BloomRingFilter {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		falsePositiveRate = 1e-6
+	}
+	bits := math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	hashes := math.Ceil(-math.Log2(falsePositiveRate))
+	return &BloomRingFilter{
+		capacity: capacity,
+		hashes:   int(hashes),
+		bits:     uint64(bits),
+	}
+}
+
+// Add records the salt
+func (f *BloomRingFilter) Add(salt []byte) {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	f.add(salt)
+}
+
+// Check reports whether the salt is new, and records it
+func (f *BloomRingFilter) Check(salt []byte) bool {
+	f.mut.Lock()
+	defer f.mut.Unlock()
+	if f.test(f.current, salt) || f.test(1-f.current, salt) {
+		return false
+	}
+	f.add(salt)
+	return true
+}
+
+func (f *BloomRingFilter) add(salt []byte) {
+	if f.filters[f.current] == nil {
+		f.filters[f.current] = make([]uint64, (f.bits+63)/64)
+	}
+	if f.count >= f.capacity {
+		f.current = 1 - f.current
+		if f.filters[f.current] == nil {
+			f.filters[f.current] = make([]uint64, (f.bits+63)/64)
+		} else {
+			for i := range f.filters[f.current] {
+				f.filters[f.current][i] = 0
+			}
+		}
+		f.count = 0
+	}
+	filter := f.filters[f.current]
+	h1, h2 := bloomHash(salt)
+	for i := 0; i != f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.bits
+		filter[bit/64] |= 1 << (bit % 64)
+	}
+	f.count++
+}
+
+func (f *BloomRingFilter) test(index int, salt []byte) bool {
+	filter := f.filters[index]
+	if filter == nil {
+		return false
+	}
+	h1, h2 := bloomHash(salt)
+	for i := 0; i != f.hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % f.bits
+		if filter[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns the two hashes combined into the k hashes of the salt
+func bloomHash(salt []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(salt)
+	h1 := h.Sum64()
+	h.Write([]byte{0})
+	h2 := h.Sum64() | 1
+	return h1, h2
+}
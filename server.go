@@ -2,7 +2,10 @@ package shadowsocks
 
 import (
 	"context"
+	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
 // Server is accepting connections and handling the details of the shadowsocks protocol
@@ -10,6 +13,9 @@ type Server struct {
 	// ProxyDial specifies the optional proxyDial function for
 	// establishing the transport connection.
 	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the optional listen function for
+	// the udp over tcp relay.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
 	// Logger error log
 	Logger Logger
 	// Context is default context
@@ -20,8 +26,44 @@ type Server struct {
 	Password string
 	// ConnCipher is connect the cipher codec
 	ConnCipher ConnCipher
+	// Users is the user table, when set each connection is matched to a user,
+	// by the ConnCipher if it is a UserCipher, otherwise by trying the users' ciphers in order,
+	// which must then be AEAD ciphers if there are several users
+	Users []*User
 	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
 	BytesPool BytesPool
+	// ProbePolicy is how to react to connections failing authentication, the default closes them
+	ProbePolicy ProbePolicy
+	// ProbeFallback is the address connections are forwarded to by ProbeFallback
+	ProbeFallback string
+	// ProbeTimeout is how long the authentication may take, and how long ProbeDrain holds a connection,
+	// the default is one minute
+	ProbeTimeout time.Duration
+	// Plugin is the SIP003 plugin executable listening in front of the server,
+	// it is used by ListenAndServe and the server listens on the loopback instead
+	Plugin string
+	// PluginOptions is passed to the plugin in SS_PLUGIN_OPTIONS
+	PluginOptions string
+	// UDPOverTCP accepts the udp packets relayed in the connections to the udp over tcp magic addresses
+	UDPOverTCP bool
+	// Handler optionally serves the decrypted connections,
+	// the default is the server itself, which dials the target and tunnels to it
+	Handler Handler
+	// ACL optionally restricts the targets, it is checked before the Handler and for each udp over tcp packet,
+	// DefaultACL denies the local networks
+	ACL *ACL
+	// Traffic optionally counts the traffic of the connections
+	Traffic *TrafficStats
+	// RateLimiter optionally limits the bandwidth of the connections
+	RateLimiter *RateLimiter
+	// ConnLimits optionally caps the connections, the rejected ones are logged and closed
+	ConnLimits *ConnLimits
+
+	mut        sync.Mutex
+	inShutdown bool
+	listeners  map[net.Listener]struct{}
+	conns      map[net.Conn]*User // by the raw conns
+	plugins    []*Plugin
 }
 
 // NewServer creates a new Server
@@ -31,6 +73,21 @@ func NewServer() *Server {
 
 // ListenAndServe is used to create a listener and serve on it
 func (s *Server) ListenAndServe(network, addr string) error {
+	if s.Plugin != "" {
+		l, plugin, err := s.listenPlugin(s.context(), network, addr)
+		if err != nil {
+			return err
+		}
+		// after Shutdown the plugin is closed once the connections are done
+		s.mut.Lock()
+		s.plugins = append(s.plugins, plugin)
+		s.mut.Unlock()
+		err = s.Serve(l)
+		if err != ErrServerClosed {
+			plugin.Close()
+		}
+		return err
+	}
 	var lc net.ListenConfig
 	l, err := lc.Listen(s.context(), network, addr)
 	if err != nil {
@@ -39,11 +96,46 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	return s.Serve(l)
 }
 
+// listenPlugin listens on the loopback and starts the plugin listening on addr in front of it
+func (s *Server) listenPlugin(ctx context.Context, network, addr string) (net.Listener, *Plugin, error) {
+	addr, err := freeAddress(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var lc net.ListenConfig
+	l, err := lc.Listen(ctx, network, "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+	plugin := &Plugin{
+		Name:          s.Plugin,
+		Options:       s.PluginOptions,
+		RemoteAddress: addr,
+		LocalAddress:  l.Addr().String(),
+		Server:        true,
+		Logger:        s.Logger,
+	}
+	err = plugin.Start(ctx)
+	if err != nil {
+		l.Close()
+		return nil, nil, err
+	}
+	return l, plugin, nil
+}
+
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 		go s.ServeConn(conn)
@@ -53,19 +145,107 @@ func (s *Server) Serve(l net.Listener) error {
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) {
 	defer conn.Close()
-	err := s.serveConn(conn)
+	if !s.trackConn(conn, true) {
+		return
+	}
+	defer s.trackConn(conn, false)
+	err := s.serveConn(conn, s.handler())
 	if err != nil && s.Logger != nil && !isClosedConnError(err) {
 		s.Logger.Println(err)
 	}
 }
 
-func (s *Server) serveConn(conn net.Conn) error {
+func (s *Server) serveConn(conn net.Conn, handler Handler) error {
 	ctx := s.context()
-	conn = s.ConnCipher.StreamConn(conn)
-	addr, err := readAddress(conn)
+	settings := s.Settings()
+	client := conn
+	admission, err := settings.ConnLimits.admit("tcp", conn.RemoteAddr())
+	if err != nil {
+		return fmt.Errorf("reject %s: %w", conn.RemoteAddr(), err)
+	}
+	defer admission.release()
+	traffic := s.Traffic.open("tcp", conn.RemoteAddr())
+	if traffic != nil {
+		defer traffic.close()
+		conn = &countConn{Conn: conn, traffic: traffic, wire: true}
+	}
+	raw := &peekConn{Conn: conn, record: s.ProbePolicy == ProbeFallback}
+	// a probe sending too few bytes to authenticate doesn't hold the connection
+	raw.SetReadDeadline(time.Now().Add(s.probeTimeout()))
+	stream, user, addr, err := s.handshake(raw, &settings)
+	if err != nil {
+		if isClosedConnError(raw.err) {
+			return err
+		}
+		return s.probe(ctx, raw, err)
+	}
+	raw.SetReadDeadline(time.Time{})
+	raw.release()
+	s.identifyConn(client, user)
+	err = admission.admitUser(user)
+	if err != nil {
+		return userError(user, fmt.Errorf("reject %s: %w", conn.RemoteAddr(), err))
+	}
+	if traffic != nil {
+		traffic.identify(user, addr)
+		stream = &countConn{Conn: stream, traffic: traffic}
+	}
+	limiter := settings.RateLimiter.open(user)
+	if limiter != nil {
+		defer limiter.close()
+		stream = newLimitConn(stream, limiter)
+	}
+	if user != nil {
+		ctx = ContextWithUser(ctx, user)
+	}
+	if !s.UDPOverTCP || !isUDPOverTCPAddress(addr) {
+		addr, err = settings.ACL.check(ctx, addr)
+		if err != nil {
+			return userError(user, err)
+		}
+	}
+	return userError(user, handler.ServeStream(ctx, user, conn.RemoteAddr(), addr, stream))
+}
+
+func (s *Server) handler() Handler {
+	if s.Handler == nil {
+		return s
+	}
+	return s.Handler
+}
+
+// ServeStream is the default Handler, it dials the target and tunnels the conn to it
+func (s *Server) ServeStream(ctx context.Context, user *User, client, target net.Addr, conn net.Conn) error {
+	addr, err := toAddress(target)
 	if err != nil {
 		return err
 	}
+	return s.serveStream(ctx, conn, addr)
+}
+
+// handshake authenticates the conn and reads the target address
+func (s *Server) handshake(conn net.Conn, settings *Settings) (net.Conn, *User, *address, error) {
+	var user *User
+	if len(settings.Users) == 0 {
+		conn = settings.ConnCipher.StreamConn(conn)
+	} else {
+		var err error
+		conn, user, err = matchUser(conn, settings.ConnCipher, settings.Users)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	addr, err := readAddress(conn)
+	if err != nil {
+		return nil, nil, nil, userError(user, err)
+	}
+	return conn, user, addr, nil
+}
+
+func (s *Server) serveStream(ctx context.Context, conn net.Conn, addr *address) error {
+	if s.UDPOverTCP && isUDPOverTCPAddress(addr) {
+		return s.serveUDPOverTCP(ctx, conn, addr)
+	}
 	c, err := s.proxyDial(ctx, "tcp", addr.String())
 	if err != nil {
 		return err
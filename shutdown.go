@@ -0,0 +1,150 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrServerClosed is returned by the Serve methods after a call to Shutdown
+var ErrServerClosed = errors.New("shadowsocks: server closed")
+
+// shutdownPollInterval is how often Shutdown checks for the connections to be done
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops accepting connections, then waits for the open ones to be done,
+// until the context is done and they are closed.
+// The Serve methods return ErrServerClosed at once, the Server can't be used again.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mut.Lock()
+	s.inShutdown = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mut.Unlock()
+
+	err := waitIdle(ctx, func() bool {
+		s.mut.Lock()
+		defer s.mut.Unlock()
+		return len(s.conns) == 0
+	})
+	s.mut.Lock()
+	if err != nil {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+	plugins := s.plugins
+	s.plugins = nil
+	s.mut.Unlock()
+	for _, plugin := range plugins {
+		plugin.Close()
+	}
+	return err
+}
+
+// trackListener adds or removes a listener being served, it reports false once shut down
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = map[net.Listener]struct{}{}
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn adds or removes a connection being served, it reports false once shut down
+func (s *Server) trackConn(conn net.Conn, add bool) bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.inShutdown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = map[net.Conn]*User{}
+	}
+	s.conns[conn] = nil
+	return true
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.inShutdown
+}
+
+// Shutdown stops accepting new udp sessions and closes the open ones at once,
+// as udp has no request to finish, then waits for them to be done until the context is done.
+// ServePacket returns ErrServerClosed, the PacketServer can't be used again.
+func (p *PacketServer) Shutdown(ctx context.Context) error {
+	p.connTableMut.Lock()
+	p.inShutdown = true
+	for k, sess := range p.connTable {
+		sess.conn.Close()
+		delete(p.connTable, k)
+	}
+	p.connTableMut.Unlock()
+
+	err := waitIdle(ctx, func() bool {
+		p.connTableMut.Lock()
+		defer p.connTableMut.Unlock()
+		return p.sessions == 0
+	})
+	p.connTableMut.Lock()
+	for conn := range p.packetConns {
+		conn.Close()
+	}
+	p.connTableMut.Unlock()
+	return err
+}
+
+// trackPacketConn adds or removes a packet conn being served, it reports false once shut down
+func (p *PacketServer) trackPacketConn(conn net.PacketConn, add bool) bool {
+	p.connTableMut.Lock()
+	defer p.connTableMut.Unlock()
+	if !add {
+		delete(p.packetConns, conn)
+		return true
+	}
+	if p.inShutdown {
+		return false
+	}
+	if p.packetConns == nil {
+		p.packetConns = map[net.PacketConn]struct{}{}
+	}
+	p.packetConns[conn] = struct{}{}
+	return true
+}
+
+func (p *PacketServer) shuttingDown() bool {
+	p.connTableMut.Lock()
+	defer p.connTableMut.Unlock()
+	return p.inShutdown
+}
+
+// waitIdle polls until idle or the context is done
+func waitIdle(ctx context.Context, idle func() bool) error {
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !idle() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
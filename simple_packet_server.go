@@ -2,9 +2,7 @@ package shadowsocks
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"net/url"
 )
 
 // SimplePacketServer is a simplified server, which can be configured as easily as client.
@@ -13,44 +11,24 @@ type SimplePacketServer struct {
 	PacketConn net.PacketConn
 	Network    string
 	Address    string
+	// Tag is the remark of the server in its URL
+	Tag string
 }
 
 // NewSimplePacketServer creates a new NewSimplePacketServer
 func NewSimplePacketServer(addr string) (*SimplePacketServer, error) {
-	s := &SimplePacketServer{
-		PacketServer: *NewPacketServer(),
-	}
-	u, err := url.Parse(addr)
+	c, cipher, err := parseEndpoint(addr)
 	if err != nil {
 		return nil, err
 	}
-	switch u.Scheme {
-	case "ss", "shadowsocks":
-	default:
-		return nil, fmt.Errorf("unsupported protocol '%s'", u.Scheme)
-	}
-	host := u.Host
-	port := u.Port()
-	if port == "" {
-		port = "8379"
-		hostname := u.Hostname()
-		host = net.JoinHostPort(hostname, port)
-	}
-
-	if u.User != nil {
-		s.Cipher, s.Password, err = GetCipherAndPasswordFromUserinfo(u.User)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	cipher, err := NewCipher(s.Cipher, s.Password)
-	if err != nil {
-		return nil, err
+	s := &SimplePacketServer{
+		PacketServer: *NewPacketServer(),
 	}
+	s.Cipher = c.Cipher
+	s.Password = c.Password
 	s.ConnCipher = cipher
-
-	s.Address = host
+	s.Tag = c.Tag
+	s.Address = c.Address
 	s.Network = "udp"
 	return s, nil
 }
@@ -92,12 +70,23 @@ func (s *SimplePacketServer) Close() error {
 	return s.PacketConn.Close()
 }
 
+// Shutdown stops accepting new udp sessions, waits for the open ones to expire until the context is done,
+// then closes the listener
+func (s *SimplePacketServer) Shutdown(ctx context.Context) error {
+	err := s.PacketServer.Shutdown(ctx)
+	if s.PacketConn != nil {
+		s.PacketConn.Close()
+	}
+	return err
+}
+
 // ProxyURL returns the URL of the proxy
 func (s *SimplePacketServer) ProxyURL() string {
-	u := url.URL{
-		Scheme: "ss",
-		User:   url.UserPassword(s.Cipher, s.Password),
-		Host:   s.Address,
+	c := Config{
+		Cipher:   s.Cipher,
+		Password: s.Password,
+		Address:  s.Address,
+		Tag:      s.Tag,
 	}
-	return u.String()
+	return c.String()
 }
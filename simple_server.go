@@ -2,9 +2,7 @@ package shadowsocks
 
 import (
 	"context"
-	"fmt"
 	"net"
-	"net/url"
 )
 
 // SimpleServer is a simplified server, which can be configured as easily as client.
@@ -13,89 +11,105 @@ type SimpleServer struct {
 	Listener net.Listener
 	Network  string
 	Address  string
+	// Tag is the remark of the server in its URL
+	Tag string
+
+	plugin *Plugin
 }
 
 // NewServer creates a new NewSimpleServer
 func NewSimpleServer(addr string) (*SimpleServer, error) {
-	s := &SimpleServer{}
-	u, err := url.Parse(addr)
-	if err != nil {
-		return nil, err
-	}
-	switch u.Scheme {
-	case "ss", "shadowsocks":
-	default:
-		return nil, fmt.Errorf("unsupported protocol '%s'", u.Scheme)
-	}
-	host := u.Host
-	port := u.Port()
-	if port == "" {
-		port = "8379"
-		hostname := u.Hostname()
-		host = net.JoinHostPort(hostname, port)
-	}
-
-	if u.User != nil {
-		s.Cipher, s.Password, err = GetCipherAndPasswordFromUserinfo(u.User)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	cipher, err := NewCipher(s.Cipher, s.Password)
+	c, cipher, err := parseEndpoint(addr)
 	if err != nil {
 		return nil, err
 	}
+	s := &SimpleServer{}
+	s.Cipher = c.Cipher
+	s.Password = c.Password
 	s.ConnCipher = cipher
-
-	s.Address = host
+	s.Plugin = c.Plugin
+	s.PluginOptions = c.PluginOptions
+	s.Tag = c.Tag
+	s.Address = c.Address
 	s.Network = "tcp"
 	return s, nil
 }
 
 // Run the server
 func (s *SimpleServer) Run(ctx context.Context) error {
-	var listenConfig net.ListenConfig
-	if s.Listener == nil {
-		listener, err := listenConfig.Listen(ctx, s.Network, s.Address)
-		if err != nil {
-			return err
-		}
-		s.Listener = listener
+	err := s.listen(ctx)
+	if err != nil {
+		return err
 	}
-	s.Address = s.Listener.Addr().String()
 	return s.Serve(s.Listener)
 }
 
 // Start the server
 func (s *SimpleServer) Start(ctx context.Context) error {
-	var listenConfig net.ListenConfig
-	if s.Listener == nil {
-		listener, err := listenConfig.Listen(ctx, s.Network, s.Address)
+	err := s.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go s.Serve(s.Listener)
+	return nil
+}
+
+func (s *SimpleServer) listen(ctx context.Context) error {
+	if s.Listener != nil {
+		s.Address = s.Listener.Addr().String()
+		return nil
+	}
+	if s.Plugin != "" {
+		// the plugin listens on the address, the clients see it instead of the listener
+		listener, plugin, err := s.listenPlugin(ctx, s.Network, s.Address)
 		if err != nil {
 			return err
 		}
 		s.Listener = listener
+		s.plugin = plugin
+		s.Address = plugin.RemoteAddress
+		return nil
+	}
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, s.Network, s.Address)
+	if err != nil {
+		return err
 	}
+	s.Listener = listener
 	s.Address = s.Listener.Addr().String()
-	go s.Serve(s.Listener)
 	return nil
 }
 
-// Close closes the listener
+// Close closes the listener and kills the plugin, if any
 func (s *SimpleServer) Close() error {
+	if s.plugin != nil {
+		s.plugin.Close()
+	}
 	if s.Listener == nil {
 		return nil
 	}
 	return s.Listener.Close()
 }
 
+// Shutdown stops accepting connections, waits for the open ones to be done until the context is done,
+// then kills the plugin, if any
+func (s *SimpleServer) Shutdown(ctx context.Context) error {
+	err := s.Server.Shutdown(ctx)
+	if s.plugin != nil {
+		s.plugin.Close()
+	}
+	return err
+}
+
 // ProxyURL returns the URL of the proxy
 func (s *SimpleServer) ProxyURL() string {
-	u := url.URL{
-		Scheme: "ss",
-		User:   url.UserPassword(s.Cipher, s.Password),
-		Host:   s.Address,
+	c := Config{
+		Cipher:        s.Cipher,
+		Password:      s.Password,
+		Address:       s.Address,
+		Plugin:        s.Plugin,
+		PluginOptions: s.PluginOptions,
+		Tag:           s.Tag,
 	}
-	return u.String()
+	return c.String()
 }
@@ -0,0 +1,350 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+// SOCKS5 protocol as defined in RFC 1928
+const (
+	socks5Version = 0x05
+
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xFF
+
+	socks5Connect      = 0x01
+	socks5UDPAssociate = 0x03
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5CommandNotSupported = 0x07
+)
+
+var (
+	errSOCKS5Version    = errors.New("unsupported socks version")
+	errSOCKS5NoAuth     = errors.New("no acceptable socks authentication method")
+	errSOCKS5Fragmented = errors.New("fragmented socks udp packet")
+	errSOCKS5Short      = errors.New("short socks udp packet")
+)
+
+// SOCKS5Local is a local SOCKS5 proxy forwarding the CONNECT and UDP ASSOCIATE requests
+// through a shadowsocks server, as sslocal does.
+type SOCKS5Local struct {
+	// ProxyDial specifies the optional dial function for
+	// the CONNECT requests, usually the DialContext of a Dialer.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the optional listen function for
+	// the UDP ASSOCIATE requests, usually the ListenPacket of a Dialer.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+	// Logger error log
+	Logger Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool BytesPool
+	Listener  net.Listener
+	Network   string
+	Address   string
+}
+
+// NewSOCKS5Local creates a new SOCKS5Local listening on the address and forwarding through the dialer
+func NewSOCKS5Local(addr string, d *Dialer) *SOCKS5Local {
+	return &SOCKS5Local{
+		ProxyDial:   d.DialContext,
+		ProxyPacket: d.ListenPacket,
+		Network:     "tcp",
+		Address:     addr,
+	}
+}
+
+// Run the SOCKS5Local
+func (l *SOCKS5Local) Run(ctx context.Context) error {
+	err := l.listen(ctx)
+	if err != nil {
+		return err
+	}
+	return l.Serve(l.Listener)
+}
+
+// Start the SOCKS5Local
+func (l *SOCKS5Local) Start(ctx context.Context) error {
+	err := l.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go l.Serve(l.Listener)
+	return nil
+}
+
+func (l *SOCKS5Local) listen(ctx context.Context) error {
+	if l.Listener == nil {
+		var listenConfig net.ListenConfig
+		listener, err := listenConfig.Listen(ctx, l.Network, l.Address)
+		if err != nil {
+			return err
+		}
+		l.Listener = listener
+	}
+	l.Address = l.Listener.Addr().String()
+	return nil
+}
+
+// Close closes the listener
+func (l *SOCKS5Local) Close() error {
+	if l.Listener == nil {
+		return nil
+	}
+	return l.Listener.Close()
+}
+
+// Serve is used to serve connections from a listener
+func (l *SOCKS5Local) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go l.ServeConn(conn)
+	}
+}
+
+// ServeConn is used to serve a single connection.
+func (l *SOCKS5Local) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	err := l.serveConn(conn)
+	if err != nil && l.Logger != nil && !isClosedConnError(err) {
+		l.Logger.Println(err)
+	}
+}
+
+func (l *SOCKS5Local) serveConn(conn net.Conn) error {
+	err := l.handshake(conn)
+	if err != nil {
+		return err
+	}
+
+	var header [3]byte
+	_, err = io.ReadFull(conn, header[:])
+	if err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errSOCKS5Version
+	}
+	addr, err := readAddress(conn)
+	if err != nil {
+		return err
+	}
+
+	ctx := l.context()
+	switch header[1] {
+	case socks5Connect:
+		return l.connect(ctx, conn, addr)
+	case socks5UDPAssociate:
+		return l.associate(ctx, conn)
+	default:
+		writeSOCKS5Reply(conn, socks5CommandNotSupported, nil)
+		return fmt.Errorf("unsupported socks command %d", header[1])
+	}
+}
+
+// handshake negotiates the authentication method, only no authentication is supported
+func (l *SOCKS5Local) handshake(conn net.Conn) error {
+	var header [2]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return errSOCKS5Version
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return err
+	}
+	if bytes.IndexByte(methods, socks5NoAuth) == -1 {
+		conn.Write([]byte{socks5Version, socks5NoAcceptable})
+		return errSOCKS5NoAuth
+	}
+	_, err = conn.Write([]byte{socks5Version, socks5NoAuth})
+	return err
+}
+
+func (l *SOCKS5Local) connect(ctx context.Context, conn net.Conn, addr *address) error {
+	target, err := l.proxyDial(ctx, "tcp", addr.String())
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5GeneralFailure, nil)
+		return err
+	}
+	// the bound address of the proxy server is unknown
+	err = writeSOCKS5Reply(conn, socks5Succeeded, nil)
+	if err != nil {
+		target.Close()
+		return err
+	}
+
+	buf1 := getBytes(l.BytesPool)
+	buf2 := getBytes(l.BytesPool)
+	defer func() {
+		putBytes(l.BytesPool, buf1)
+		putBytes(l.BytesPool, buf2)
+	}()
+	return tunnel(ctx, target, conn, buf1, buf2)
+}
+
+// associate relays the udp packets of the client until the conn is closed
+func (l *SOCKS5Local) associate(ctx context.Context, conn net.Conn) error {
+	host, _, err := net.SplitHostPort(conn.LocalAddr().String())
+	if err != nil {
+		return err
+	}
+	var listenConfig net.ListenConfig
+	local, err := listenConfig.ListenPacket(ctx, "udp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5GeneralFailure, nil)
+		return err
+	}
+	defer local.Close()
+	relay, err := l.proxyListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		writeSOCKS5Reply(conn, socks5GeneralFailure, nil)
+		return err
+	}
+	defer relay.Close()
+
+	bound, _ := toAddress(local.LocalAddr())
+	err = writeSOCKS5Reply(conn, socks5Succeeded, bound)
+	if err != nil {
+		return err
+	}
+
+	var clientIP net.IP
+	if a, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = a.IP
+	}
+	var mut sync.Mutex
+	var client net.Addr
+
+	go func() {
+		buf := getBytes(l.BytesPool)
+		defer putBytes(l.BytesPool, buf)
+		for {
+			n, from, err := local.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			// only the client of the association is served
+			if a, ok := from.(*net.UDPAddr); ok && clientIP != nil && !a.IP.Equal(clientIP) {
+				continue
+			}
+			data, to, err := splitSOCKS5Packet(buf[:n])
+			if err != nil {
+				if l.Logger != nil {
+					l.Logger.Println(fmt.Errorf("socks udp from %s: %w", from, err))
+				}
+				continue
+			}
+			mut.Lock()
+			client = from
+			mut.Unlock()
+			_, err = relay.WriteTo(data, to)
+			if err != nil && l.Logger != nil {
+				l.Logger.Println(fmt.Errorf("socks udp to %s: %w", to, err))
+			}
+		}
+	}()
+	go func() {
+		buf := getBytes(l.BytesPool)
+		defer putBytes(l.BytesPool, buf)
+		reply := getBytes(l.BytesPool)
+		defer putBytes(l.BytesPool, reply)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mut.Lock()
+			to := client
+			mut.Unlock()
+			if to == nil {
+				continue
+			}
+			a, err := toAddress(from)
+			if err != nil {
+				continue
+			}
+			b := bytes.NewBuffer(reply[:0])
+			b.Write([]byte{0, 0, 0})
+			err = writeAddress(b, a)
+			if err != nil {
+				continue
+			}
+			b.Write(buf[:n])
+			local.WriteTo(b.Bytes(), to)
+		}
+	}()
+
+	// the association lasts as long as the conn
+	_, err = io.Copy(ioutil.Discard, conn)
+	return err
+}
+
+// splitSOCKS5Packet returns the payload and the destination of a socks udp packet
+func splitSOCKS5Packet(b []byte) ([]byte, net.Addr, error) {
+	if len(b) < 3 {
+		return nil, nil, errSOCKS5Short
+	}
+	if b[2] != 0 {
+		return nil, nil, errSOCKS5Fragmented
+	}
+	r := bytes.NewReader(b[3:])
+	addr, err := readAddress(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b[len(b)-r.Len():], toPacketAddr(addr), nil
+}
+
+// writeSOCKS5Reply writes the reply of a request
+func writeSOCKS5Reply(w io.Writer, rep byte, addr *address) error {
+	var buf bytes.Buffer
+	buf.Write([]byte{socks5Version, rep, 0})
+	err := writeAddress(&buf, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (l *SOCKS5Local) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyDial := l.ProxyDial
+	if proxyDial == nil {
+		var dialer net.Dialer
+		proxyDial = dialer.DialContext
+	}
+	return proxyDial(ctx, network, address)
+}
+
+func (l *SOCKS5Local) proxyListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	proxyPacket := l.ProxyPacket
+	if proxyPacket == nil {
+		var listenConfig net.ListenConfig
+		proxyPacket = listenConfig.ListenPacket
+	}
+	return proxyPacket(ctx, network, address)
+}
+
+func (l *SOCKS5Local) context() context.Context {
+	if l.Context == nil {
+		return context.Background()
+	}
+	return l.Context
+}
@@ -0,0 +1,329 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// PortConfig is a port of a Supervisor, with its own cipher, users, ACL and limits
+type PortConfig struct {
+	ServerConfig
+	// Users is the user table, see the Users of the Server
+	Users []*User
+	// ACL optionally restricts the targets
+	ACL *ACL
+	// RateLimiter optionally limits the bandwidth
+	RateLimiter *RateLimiter
+	// ConnLimits optionally caps the connections and the udp sessions
+	ConnLimits *ConnLimits
+}
+
+func (c *PortConfig) settings() Settings {
+	return Settings{
+		Cipher:      c.Cipher,
+		Password:    c.Password,
+		Users:       c.Users,
+		ACL:         c.ACL,
+		RateLimiter: c.RateLimiter,
+		ConnLimits:  c.ConnLimits,
+	}
+}
+
+// reloadable reports whether the port can go from the config to the other one by a reload,
+// otherwise its servers are restarted
+func (c *PortConfig) reloadable(o *PortConfig) bool {
+	return c.Mode == o.Mode &&
+		c.Timeout == o.Timeout &&
+		c.Plugin == o.Plugin &&
+		c.PluginOptions == o.PluginOptions
+}
+
+// Supervisor runs the SimpleServer and the SimplePacketServer of several ports,
+// the ports are added, reloaded and removed while running, by their address.
+type Supervisor struct {
+	// Logger error log
+	Logger Logger
+	// Context is default context
+	Context context.Context
+	// UDPOverTCP accepts the udp packets relayed in the connections to the udp over tcp magic addresses
+	UDPOverTCP bool
+	// Traffic optionally counts the traffic of all the ports
+	Traffic *TrafficStats
+
+	mut   sync.Mutex
+	ports map[string]*supervisedPort
+}
+
+// supervisedPort is the servers of a port, either is nil by the mode
+type supervisedPort struct {
+	config *PortConfig
+	tcp    *SimpleServer
+	udp    *SimplePacketServer
+}
+
+// NewSupervisor creates a new Supervisor without ports
+func NewSupervisor() *Supervisor {
+	return &Supervisor{}
+}
+
+// Ports returns the configs of the running ports, sorted by address
+func (s *Supervisor) Ports() []*PortConfig {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	configs := make([]*PortConfig, 0, len(s.ports))
+	for _, port := range s.ports {
+		configs = append(configs, port.config)
+	}
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Address < configs[j].Address
+	})
+	return configs
+}
+
+// Add starts the servers of a port
+func (s *Supervisor) Add(config *PortConfig) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := s.ports[config.Address]; ok {
+		return fmt.Errorf("port %s: already running", config.Address)
+	}
+	port, err := s.start(config)
+	if err != nil {
+		return fmt.Errorf("port %s: %w", config.Address, err)
+	}
+	if s.ports == nil {
+		s.ports = map[string]*supervisedPort{}
+	}
+	s.ports[config.Address] = port
+	return nil
+}
+
+// Reload replaces the cipher, the users, the ACL and the limits of a running port,
+// the open connections go on, except those of the removed users when closeRemoved is set.
+// The mode, the timeout and the plugin can't be reloaded, the port is to be removed and added again.
+func (s *Supervisor) Reload(config *PortConfig, closeRemoved bool) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	port, ok := s.ports[config.Address]
+	if !ok {
+		return fmt.Errorf("port %s: not running", config.Address)
+	}
+	if !port.config.reloadable(config) {
+		return fmt.Errorf("port %s: the mode, the timeout and the plugin can't be reloaded", config.Address)
+	}
+	err := port.reload(config, closeRemoved)
+	if err != nil {
+		return fmt.Errorf("port %s: %w", config.Address, err)
+	}
+	return nil
+}
+
+// Remove stops the servers of a port, waiting for the open connections until the context is done
+func (s *Supervisor) Remove(ctx context.Context, address string) error {
+	s.mut.Lock()
+	port, ok := s.ports[address]
+	delete(s.ports, address)
+	s.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("port %s: not running", address)
+	}
+	return shutdownPorts(ctx, []*supervisedPort{port})
+}
+
+// Apply makes the running ports those of the configs, it adds the new ports, reloads the changed ones
+// and removes the others, waiting for their open connections until the context is done.
+// The ports whose mode, timeout or plugin changed are removed and added again.
+func (s *Supervisor) Apply(ctx context.Context, configs []*PortConfig, closeRemoved bool) error {
+	wanted := map[string]*PortConfig{}
+	for _, config := range configs {
+		if _, ok := wanted[config.Address]; ok {
+			return fmt.Errorf("port %s: configured twice", config.Address)
+		}
+		wanted[config.Address] = config
+	}
+
+	s.mut.Lock()
+	var stale []*supervisedPort
+	for address, port := range s.ports {
+		config, ok := wanted[address]
+		if ok && port.config.reloadable(config) {
+			continue
+		}
+		stale = append(stale, port)
+		delete(s.ports, address)
+	}
+	s.mut.Unlock()
+	err := shutdownPorts(ctx, stale)
+	if err != nil && s.Logger != nil {
+		s.Logger.Println(err)
+	}
+
+	var errs []error
+	for _, config := range configs {
+		s.mut.Lock()
+		_, ok := s.ports[config.Address]
+		s.mut.Unlock()
+		if ok {
+			err = s.Reload(config, closeRemoved)
+		} else {
+			err = s.Add(config)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch len(errs) {
+	case 0:
+		return nil
+	case 1:
+		return errs[0]
+	}
+	return fmt.Errorf("%w, and %d more errors", errs[0], len(errs)-1)
+}
+
+// Shutdown stops the servers of all the ports, waiting for the open connections until the context is done
+func (s *Supervisor) Shutdown(ctx context.Context) error {
+	s.mut.Lock()
+	ports := make([]*supervisedPort, 0, len(s.ports))
+	for _, port := range s.ports {
+		ports = append(ports, port)
+	}
+	s.ports = nil
+	s.mut.Unlock()
+	return shutdownPorts(ctx, ports)
+}
+
+func (s *Supervisor) start(config *PortConfig) (*supervisedPort, error) {
+	port := &supervisedPort{
+		config: config,
+	}
+	settings := config.settings()
+	err := settings.connCipher(nil)
+	if err != nil {
+		return nil, err
+	}
+	// the settings of both servers are checked before starting either
+	var tcp *SimpleServer
+	if config.TCP() {
+		tcp = &SimpleServer{
+			Network: "tcp",
+			Address: config.Address,
+			Tag:     config.Tag,
+		}
+		tcp.Logger = s.Logger
+		tcp.Context = s.context()
+		tcp.Plugin = config.Plugin
+		tcp.PluginOptions = config.PluginOptions
+		tcp.UDPOverTCP = s.UDPOverTCP
+		tcp.Traffic = s.Traffic
+		err = tcp.Reload(settings, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var udp *SimplePacketServer
+	if config.UDP() {
+		udp = &SimplePacketServer{
+			PacketServer: *NewPacketServer(),
+			Network:      "udp",
+			Address:      config.Address,
+			Tag:          config.Tag,
+		}
+		udp.Logger = s.Logger
+		udp.Context = s.context()
+		udp.Timeout = config.Timeout
+		udp.Traffic = s.Traffic
+		err = udp.Reload(settings, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tcp != nil {
+		err = tcp.Start(s.context())
+		if err != nil {
+			return nil, err
+		}
+		port.tcp = tcp
+	}
+	if udp != nil {
+		if tcp != nil {
+			// the udp server is on the same port, even a random one
+			udp.Address = tcp.Address
+		}
+		err = udp.Start(s.context())
+		if err != nil {
+			if tcp != nil {
+				tcp.Close()
+			}
+			return nil, err
+		}
+		port.udp = udp
+	}
+	return port, nil
+}
+
+func (s *Supervisor) context() context.Context {
+	if s.Context == nil {
+		return context.Background()
+	}
+	return s.Context
+}
+
+func (p *supervisedPort) reload(config *PortConfig, closeRemoved bool) error {
+	settings := config.settings()
+	err := settings.connCipher(nil)
+	if err != nil {
+		return err
+	}
+	if p.tcp != nil {
+		err = p.tcp.Reload(settings, closeRemoved)
+		if err != nil {
+			return err
+		}
+	}
+	if p.udp != nil {
+		err = p.udp.Reload(settings, closeRemoved)
+		if err != nil {
+			return err
+		}
+	}
+	p.config = config
+	return nil
+}
+
+// shutdownPorts shuts the servers of the ports down at once, it returns the first error
+func shutdownPorts(ctx context.Context, ports []*supervisedPort) error {
+	errCh := make(chan error, 2*len(ports))
+	n := 0
+	for _, port := range ports {
+		if port.tcp != nil {
+			n++
+			go func(tcp *SimpleServer, address string) {
+				err := tcp.Shutdown(ctx)
+				if err != nil {
+					err = fmt.Errorf("port %s: %w", address, err)
+				}
+				errCh <- err
+			}(port.tcp, port.config.Address)
+		}
+		if port.udp != nil {
+			n++
+			go func(udp *SimplePacketServer, address string) {
+				err := udp.Shutdown(ctx)
+				if err != nil {
+					err = fmt.Errorf("port %s: %w", address, err)
+				}
+				errCh <- err
+			}(port.udp, port.config.Address)
+		}
+	}
+	var err error
+	for i := 0; i != n; i++ {
+		if e := <-errCh; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,257 @@
+package shadowsocks
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic counts the bytes relayed for the clients, the upload is from them and the download to them
+type Traffic struct {
+	// Upload is the plaintext bytes from the clients
+	Upload int64
+	// Download is the plaintext bytes to the clients
+	Download int64
+	// UploadWire is the encrypted bytes received from the clients
+	UploadWire int64
+	// DownloadWire is the encrypted bytes sent to the clients
+	DownloadWire int64
+}
+
+func (t *Traffic) add(o Traffic) {
+	if o.Upload != 0 {
+		atomic.AddInt64(&t.Upload, o.Upload)
+	}
+	if o.Download != 0 {
+		atomic.AddInt64(&t.Download, o.Download)
+	}
+	if o.UploadWire != 0 {
+		atomic.AddInt64(&t.UploadWire, o.UploadWire)
+	}
+	if o.DownloadWire != 0 {
+		atomic.AddInt64(&t.DownloadWire, o.DownloadWire)
+	}
+}
+
+func (t *Traffic) load() Traffic {
+	return Traffic{
+		Upload:       atomic.LoadInt64(&t.Upload),
+		Download:     atomic.LoadInt64(&t.Download),
+		UploadWire:   atomic.LoadInt64(&t.UploadWire),
+		DownloadWire: atomic.LoadInt64(&t.DownloadWire),
+	}
+}
+
+func (t *Traffic) swap() Traffic {
+	return Traffic{
+		Upload:       atomic.SwapInt64(&t.Upload, 0),
+		Download:     atomic.SwapInt64(&t.Download, 0),
+		UploadWire:   atomic.SwapInt64(&t.UploadWire, 0),
+		DownloadWire: atomic.SwapInt64(&t.DownloadWire, 0),
+	}
+}
+
+// ConnTraffic is the traffic of a tcp connection or an udp session
+type ConnTraffic struct {
+	// Network is tcp or udp
+	Network string
+	// User is the name of the matched user, empty when the server has no users or it failed authentication
+	User string
+	// Client is the address of the client
+	Client net.Addr
+	// Target is the address the client asked for, empty when it failed authentication
+	Target string
+	// Start is when the connection or the session started
+	Start time.Time
+	Traffic
+}
+
+// TrafficStats counts the traffic of a server, in total, per user and per connection.
+// It can be shared by several servers, such as the Server and the PacketServer on a port.
+type TrafficStats struct {
+	// total is first to be aligned for the atomic operations
+	total Traffic
+
+	// OnClose optionally receives the traffic of each tcp connection and udp session when it ends
+	OnClose func(ConnTraffic)
+
+	mut   sync.Mutex
+	users map[string]*Traffic
+	conns map[*connTraffic]struct{}
+}
+
+// NewTrafficStats creates a new TrafficStats
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{}
+}
+
+// Total returns the traffic of all the connections
+func (s *TrafficStats) Total() Traffic {
+	return s.total.load()
+}
+
+// Users returns the traffic of each user by name
+func (s *TrafficStats) Users() map[string]Traffic {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	users := make(map[string]Traffic, len(s.users))
+	for name, t := range s.users {
+		users[name] = t.load()
+	}
+	return users
+}
+
+// Connections returns the traffic of the open connections and sessions since they started
+func (s *TrafficStats) Connections() []ConnTraffic {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	conns := make([]ConnTraffic, 0, len(s.conns))
+	for c := range s.conns {
+		conns = append(conns, c.snapshot())
+	}
+	return conns
+}
+
+// Reset returns the total and the per user traffic and starts counting them again from zero,
+// the traffic of the open connections is kept
+func (s *TrafficStats) Reset() (total Traffic, users map[string]Traffic) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	users = make(map[string]Traffic, len(s.users))
+	for name, t := range s.users {
+		users[name] = t.swap()
+	}
+	return s.total.swap(), users
+}
+
+// open starts counting a connection, a nil TrafficStats counts nothing
+func (s *TrafficStats) open(network string, client net.Addr) *connTraffic {
+	if s == nil {
+		return nil
+	}
+	c := &connTraffic{
+		stats: s,
+		info: ConnTraffic{
+			Network: network,
+			Client:  client,
+			Start:   time.Now(),
+		},
+	}
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.conns == nil {
+		s.conns = map[*connTraffic]struct{}{}
+	}
+	s.conns[c] = struct{}{}
+	return c
+}
+
+// connTraffic counts the traffic of a connection into its stats
+type connTraffic struct {
+	traffic Traffic
+	stats   *TrafficStats
+	mut     sync.Mutex
+	info    ConnTraffic
+	user    *Traffic
+}
+
+// identify sets the user and the target of the connection once authenticated,
+// the traffic until then is added to the user
+func (c *connTraffic) identify(user *User, target net.Addr) {
+	if c == nil {
+		return
+	}
+	var counter *Traffic
+	if user != nil {
+		s := c.stats
+		s.mut.Lock()
+		if s.users == nil {
+			s.users = map[string]*Traffic{}
+		}
+		counter = s.users[user.Name]
+		if counter == nil {
+			counter = &Traffic{}
+			s.users[user.Name] = counter
+		}
+		s.mut.Unlock()
+	}
+	c.mut.Lock()
+	c.info.Target = target.String()
+	if user == nil {
+		c.mut.Unlock()
+		return
+	}
+	c.info.User = user.Name
+	c.user = counter
+	pending := c.traffic.load()
+	c.mut.Unlock()
+	counter.add(pending)
+}
+
+func (c *connTraffic) add(t Traffic) {
+	if c == nil {
+		return
+	}
+	c.stats.total.add(t)
+	c.mut.Lock()
+	c.traffic.add(t)
+	user := c.user
+	c.mut.Unlock()
+	if user != nil {
+		user.add(t)
+	}
+}
+
+func (c *connTraffic) snapshot() ConnTraffic {
+	c.mut.Lock()
+	info := c.info
+	c.mut.Unlock()
+	info.Traffic = c.traffic.load()
+	return info
+}
+
+// close stops counting the connection and reports its traffic
+func (c *connTraffic) close() {
+	if c == nil {
+		return
+	}
+	s := c.stats
+	s.mut.Lock()
+	delete(s.conns, c)
+	s.mut.Unlock()
+	if s.OnClose != nil {
+		s.OnClose(c.snapshot())
+	}
+}
+
+// countConn counts the bytes read and written, as the wire or the plaintext traffic
+type countConn struct {
+	net.Conn
+	traffic *connTraffic
+	wire    bool
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if c.wire {
+			c.traffic.add(Traffic{UploadWire: int64(n)})
+		} else {
+			c.traffic.add(Traffic{Upload: int64(n)})
+		}
+	}
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		if c.wire {
+			c.traffic.add(Traffic{DownloadWire: int64(n)})
+		} else {
+			c.traffic.add(Traffic{Download: int64(n)})
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,256 @@
+package shadowsocks
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Tunnel forwards the local tcp connections and udp packets through a shadowsocks server
+// to a fixed target, as ss-tunnel does.
+type Tunnel struct {
+	// ProxyDial specifies the optional dial function for
+	// the tcp connections to the target, usually the DialContext of a Dialer.
+	ProxyDial func(context.Context, string, string) (net.Conn, error)
+	// ProxyPacket specifies the optional listen function for
+	// the udp packets to the target, usually the ListenPacket of a Dialer.
+	ProxyPacket func(ctx context.Context, network, address string) (net.PacketConn, error)
+	// Target is the address everything is forwarded to
+	Target string
+	// Timeout is the idle time after which a udp session is closed, the default is one minute
+	Timeout time.Duration
+	// Logger error log
+	Logger Logger
+	// Context is default context
+	Context context.Context
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	BytesPool  BytesPool
+	Listener   net.Listener
+	PacketConn net.PacketConn
+	Address    string
+
+	sessionsMut sync.Mutex
+	sessions    map[string]net.PacketConn
+}
+
+// NewTunnel creates a new Tunnel listening on the address and forwarding to the target through the dialer
+func NewTunnel(addr, target string, d *Dialer) *Tunnel {
+	return &Tunnel{
+		ProxyDial:   d.DialContext,
+		ProxyPacket: d.ListenPacket,
+		Target:      target,
+		Address:     addr,
+	}
+}
+
+// Run the Tunnel, it returns when either the tcp or the udp side fails
+func (t *Tunnel) Run(ctx context.Context) error {
+	err := t.listen(ctx)
+	if err != nil {
+		return err
+	}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- t.Serve(t.Listener)
+	}()
+	go func() {
+		errCh <- t.ServePacket(t.PacketConn)
+	}()
+	return <-errCh
+}
+
+// Start the Tunnel
+func (t *Tunnel) Start(ctx context.Context) error {
+	err := t.listen(ctx)
+	if err != nil {
+		return err
+	}
+	go t.Serve(t.Listener)
+	go t.ServePacket(t.PacketConn)
+	return nil
+}
+
+// listen listens on the same address for tcp and udp
+func (t *Tunnel) listen(ctx context.Context) error {
+	var listenConfig net.ListenConfig
+	if t.Listener == nil {
+		listener, err := listenConfig.Listen(ctx, "tcp", t.Address)
+		if err != nil {
+			return err
+		}
+		t.Listener = listener
+	}
+	t.Address = t.Listener.Addr().String()
+	if t.PacketConn == nil {
+		packetConn, err := listenConfig.ListenPacket(ctx, "udp", t.Address)
+		if err != nil {
+			t.Listener.Close()
+			return err
+		}
+		t.PacketConn = packetConn
+	}
+	return nil
+}
+
+// Close closes the listener and the packet conn
+func (t *Tunnel) Close() error {
+	var err error
+	if t.Listener != nil {
+		err = t.Listener.Close()
+	}
+	if t.PacketConn != nil {
+		e := t.PacketConn.Close()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Serve is used to serve connections from a listener
+func (t *Tunnel) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go t.ServeConn(conn)
+	}
+}
+
+// ServeConn is used to serve a single connection.
+func (t *Tunnel) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	ctx := t.context()
+	target, err := t.proxyDial(ctx, "tcp", t.Target)
+	if err != nil {
+		if t.Logger != nil {
+			t.Logger.Println(err)
+		}
+		return
+	}
+	buf1 := getBytes(t.BytesPool)
+	buf2 := getBytes(t.BytesPool)
+	defer func() {
+		putBytes(t.BytesPool, buf1)
+		putBytes(t.BytesPool, buf2)
+	}()
+	err = tunnel(ctx, target, conn, buf1, buf2)
+	if err != nil && t.Logger != nil && !isClosedConnError(err) {
+		t.Logger.Println(err)
+	}
+}
+
+// ServePacket forwards the packets of each client in its own session
+func (t *Tunnel) ServePacket(conn net.PacketConn) error {
+	addr, err := parseAddress(t.Target)
+	if err != nil {
+		return err
+	}
+	target := toPacketAddr(addr)
+	buf := getBytes(t.BytesPool)
+	defer putBytes(t.BytesPool, buf)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		sess, err := t.session(conn, from)
+		if err != nil {
+			if t.Logger != nil {
+				t.Logger.Println(err)
+			}
+			continue
+		}
+		sess.SetReadDeadline(time.Now().Add(t.timeout()))
+		_, err = sess.WriteTo(buf[:n], target)
+		if err != nil && t.Logger != nil {
+			t.Logger.Println(fmt.Errorf("udp tunnel to %s: %w", t.Target, err))
+		}
+	}
+}
+
+// session returns the packet conn relaying the packets of the client, the replies go back to it
+func (t *Tunnel) session(conn net.PacketConn, client net.Addr) (net.PacketConn, error) {
+	key := client.String()
+	t.sessionsMut.Lock()
+	sess, ok := t.sessions[key]
+	t.sessionsMut.Unlock()
+	if ok {
+		return sess, nil
+	}
+	// the proxy may be dialed, such as for udp over tcp, without holding the other sessions
+	sess, err := t.proxyListenPacket(t.context(), "udp", ":0")
+	if err != nil {
+		return nil, err
+	}
+	t.sessionsMut.Lock()
+	if other, ok := t.sessions[key]; ok {
+		// another packet of the client created the session meanwhile
+		t.sessionsMut.Unlock()
+		sess.Close()
+		return other, nil
+	}
+	if t.sessions == nil {
+		t.sessions = map[string]net.PacketConn{}
+	}
+	t.sessions[key] = sess
+	t.sessionsMut.Unlock()
+
+	go func() {
+		defer func() {
+			t.sessionsMut.Lock()
+			delete(t.sessions, key)
+			t.sessionsMut.Unlock()
+			sess.Close()
+		}()
+		buf := getBytes(t.BytesPool)
+		defer putBytes(t.BytesPool, buf)
+		for {
+			// the session ends when idle for the timeout
+			n, _, err := sess.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, err = conn.WriteTo(buf[:n], client)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return sess, nil
+}
+
+func (t *Tunnel) timeout() time.Duration {
+	if t.Timeout == 0 {
+		return time.Minute
+	}
+	return t.Timeout
+}
+
+func (t *Tunnel) proxyDial(ctx context.Context, network, address string) (net.Conn, error) {
+	proxyDial := t.ProxyDial
+	if proxyDial == nil {
+		var dialer net.Dialer
+		proxyDial = dialer.DialContext
+	}
+	return proxyDial(ctx, network, address)
+}
+
+func (t *Tunnel) proxyListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	proxyPacket := t.ProxyPacket
+	if proxyPacket == nil {
+		var listenConfig net.ListenConfig
+		proxyPacket = listenConfig.ListenPacket
+	}
+	return proxyPacket(ctx, network, address)
+}
+
+func (t *Tunnel) context() context.Context {
+	if t.Context == nil {
+		return context.Background()
+	}
+	return t.Context
+}
@@ -0,0 +1,357 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+const (
+	// UDPOverTCPMagicAddress is the target address of the udp over tcp streams, version 2
+	UDPOverTCPMagicAddress = "sp.v2.udp-over-tcp.arpa"
+	// UDPOverTCPLegacyMagicAddress is the target address of the udp over tcp streams, version 1
+	UDPOverTCPLegacyMagicAddress = "sp.udp-over-tcp.arpa"
+)
+
+// address families of the udp over tcp addresses
+const (
+	uotIPv4Address   = 0x00
+	uotIPv6Address   = 0x01
+	uotDomainAddress = 0x02
+)
+
+// maxUDPOverTCPPacket is the maximum length of a framed packet
+const maxUDPOverTCPPacket = 0xFFFF
+
+var errUDPOverTCPPacketTooLarge = errors.New("udp over tcp packet too large")
+
+// isUDPOverTCPAddress reports whether the target address asks for udp over tcp
+func isUDPOverTCPAddress(addr *address) bool {
+	return addr.IP == nil && (addr.Name == UDPOverTCPMagicAddress || addr.Name == UDPOverTCPLegacyMagicAddress)
+}
+
+// writeUDPOverTCPAddress writes the address in the udp over tcp format,
+// it is the socks address with the families numbered from zero.
+func writeUDPOverTCPAddress(w *bytes.Buffer, addr *address) error {
+	if ip := addr.IP.To4(); ip != nil {
+		w.WriteByte(uotIPv4Address)
+		w.Write(ip)
+	} else if ip := addr.IP.To16(); ip != nil {
+		w.WriteByte(uotIPv6Address)
+		w.Write(ip)
+	} else {
+		if len(addr.Name) > 255 {
+			return errUnrecognizedAddrType
+		}
+		w.WriteByte(uotDomainAddress)
+		w.WriteByte(byte(len(addr.Name)))
+		w.WriteString(addr.Name)
+	}
+	var port [2]byte
+	binary.BigEndian.PutUint16(port[:], uint16(addr.Port))
+	w.Write(port[:])
+	return nil
+}
+
+// readUDPOverTCPAddress reads an address in the udp over tcp format
+func readUDPOverTCPAddress(r io.Reader) (*address, error) {
+	addr := &address{}
+	var b [256]byte
+	_, err := io.ReadFull(r, b[:1])
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case uotIPv4Address:
+		_, err = io.ReadFull(r, b[:net.IPv4len])
+		addr.IP = net.IP(append([]byte(nil), b[:net.IPv4len]...))
+	case uotIPv6Address:
+		_, err = io.ReadFull(r, b[:net.IPv6len])
+		addr.IP = net.IP(append([]byte(nil), b[:net.IPv6len]...))
+	case uotDomainAddress:
+		_, err = io.ReadFull(r, b[:1])
+		if err != nil {
+			return nil, err
+		}
+		l := int(b[0])
+		_, err = io.ReadFull(r, b[:l])
+		addr.Name = string(b[:l])
+	default:
+		return nil, errUnrecognizedAddrType
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.ReadFull(r, b[:2])
+	if err != nil {
+		return nil, err
+	}
+	addr.Port = int(binary.BigEndian.Uint16(b[:2]))
+	return addr, nil
+}
+
+// udpOverTCPConn carries the packets in a stream, each one is framed as
+// the address, unless connected, the length in two bytes and the payload.
+type udpOverTCPConn struct {
+	net.Conn
+	// connected is set when the packets are all to and from the remote address
+	connected bool
+	remote    *address
+	rmut      sync.Mutex
+	wmut      sync.Mutex
+}
+
+// newUDPOverTCPConn reads the request of a version 2 stream, the legacy ones have none
+func newUDPOverTCPConn(conn net.Conn, addr *address) (*udpOverTCPConn, error) {
+	c := &udpOverTCPConn{Conn: conn}
+	if addr.Name == UDPOverTCPLegacyMagicAddress {
+		return c, nil
+	}
+	var connected [1]byte
+	_, err := io.ReadFull(conn, connected[:])
+	if err != nil {
+		return nil, err
+	}
+	remote, err := readUDPOverTCPAddress(conn)
+	if err != nil {
+		return nil, err
+	}
+	c.connected = connected[0] != 0
+	c.remote = remote
+	return c, nil
+}
+
+// writeUDPOverTCPRequest writes the request of a version 2 stream
+func writeUDPOverTCPRequest(conn net.Conn, connected bool, remote *address) error {
+	var buf bytes.Buffer
+	if connected {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	err := writeUDPOverTCPAddress(&buf, remote)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func (c *udpOverTCPConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmut.Lock()
+	defer c.rmut.Unlock()
+	addr := c.remote
+	if !c.connected {
+		var err error
+		addr, err = readUDPOverTCPAddress(c.Conn)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	var l [2]byte
+	_, err := io.ReadFull(c.Conn, l[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint16(l[:]))
+	n := size
+	if n > len(b) {
+		n = len(b)
+	}
+	_, err = io.ReadFull(c.Conn, b[:n])
+	if err != nil {
+		return 0, nil, err
+	}
+	if n < size {
+		// the rest of a truncated packet is discarded
+		_, err = io.CopyN(ioutil.Discard, c.Conn, int64(size-n))
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	if addr.IP != nil {
+		return n, &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+	}
+	return n, addr, nil
+}
+
+func (c *udpOverTCPConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > maxUDPOverTCPPacket {
+		return 0, errUDPOverTCPPacketTooLarge
+	}
+	var buf bytes.Buffer
+	if !c.connected {
+		a, err := toAddress(addr)
+		if err != nil {
+			return 0, err
+		}
+		err = writeUDPOverTCPAddress(&buf, a)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(b)))
+	buf.Write(l[:])
+	buf.Write(b)
+
+	c.wmut.Lock()
+	defer c.wmut.Unlock()
+	_, err := c.Conn.Write(buf.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *udpOverTCPConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *udpOverTCPConn) Write(b []byte) (int, error) {
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *udpOverTCPConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	if c.remote.IP != nil {
+		return &net.UDPAddr{IP: c.remote.IP, Port: c.remote.Port}
+	}
+	return c.remote
+}
+
+// toAddress converts the net.Addr without resolving it
+func toAddress(addr net.Addr) (*address, error) {
+	switch a := addr.(type) {
+	case *address:
+		return a, nil
+	case *net.UDPAddr:
+		return &address{IP: a.IP, Port: a.Port}, nil
+	}
+	return parseAddress(addr.String())
+}
+
+// dialUDPOverTCP opens a udp over tcp stream through the proxy server,
+// when remote is set all the packets are to and from it.
+func (d *Dialer) dialUDPOverTCP(ctx context.Context, remote *address) (*udpOverTCPConn, error) {
+	conn, err := d.connectAddress(ctx, &address{Name: UDPOverTCPMagicAddress})
+	if err != nil {
+		return nil, err
+	}
+	connected := remote != nil
+	if !connected {
+		remote = &address{IP: net.IPv4zero}
+	}
+	err = writeUDPOverTCPRequest(conn, connected, remote)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &udpOverTCPConn{
+		Conn:      conn,
+		connected: connected,
+		remote:    remote,
+	}, nil
+}
+
+// serveUDPOverTCP relays the packets of the stream
+func (s *Server) serveUDPOverTCP(ctx context.Context, conn net.Conn, addr *address) error {
+	uc, err := newUDPOverTCPConn(conn, addr)
+	if err != nil {
+		return err
+	}
+	var target net.Addr
+	if uc.connected {
+		remote, err := s.Settings().ACL.check(ctx, uc.remote)
+		if err != nil {
+			return err
+		}
+		target, err = toUDPAddr(remote)
+		if err != nil {
+			return err
+		}
+	}
+	pc, err := s.proxyListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return err
+	}
+
+	// the buffers hold the largest packets, a truncated one can't be framed
+	errCh := make(chan error, 2)
+	go func() {
+		buf := make([]byte, maxUDPOverTCPPacket)
+		for {
+			n, from, err := pc.ReadFrom(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			_, err = uc.WriteTo(buf[:n], from)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPOverTCPPacket)
+		for {
+			n, to, err := uc.ReadFrom(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			if uc.connected {
+				to = target
+			} else if checked, err := s.Settings().ACL.check(ctx, to); err != nil {
+				// the denied packets are dropped
+				if s.Logger != nil {
+					s.Logger.Println(fmt.Errorf("udp over tcp: %w", err))
+				}
+				continue
+			} else if udpAddr, err := toUDPAddr(checked); err == nil {
+				to = udpAddr
+			} else {
+				errCh <- fmt.Errorf("udp over tcp to %s: %w", to, err)
+				return
+			}
+			_, err = pc.WriteTo(buf[:n], to)
+			if err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+	defer func() {
+		pc.Close()
+		conn.Close()
+	}()
+
+	select {
+	case err := <-errCh:
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) proxyListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	proxyPacket := s.ProxyPacket
+	if proxyPacket == nil {
+		var listenConfig net.ListenConfig
+		proxyPacket = listenConfig.ListenPacket
+	}
+	return proxyPacket(ctx, network, address)
+}
@@ -0,0 +1,112 @@
+package shadowsocks
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// defaultPort is the port of the URLs without one
+const defaultPort = "8379"
+
+// Config is a shadowsocks server as described by a SIP002 URI,
+// ss://userinfo@host:port/?plugin=name;options#tag
+type Config struct {
+	// Cipher use cipher protocol
+	Cipher string
+	// Password use password authentication
+	Password string
+	// Address is the host and port of the server
+	Address string
+	// Plugin is the SIP003 plugin executable
+	Plugin string
+	// PluginOptions is passed to the plugin in SS_PLUGIN_OPTIONS
+	PluginOptions string
+	// Tag is the remark of the server
+	Tag string
+}
+
+// ParseURL parses a SIP002 URI, the userinfo is either base64 encoded
+// or plain with a percent-encoded password, and the port defaults to 8379.
+func ParseURL(rawurl string) (*Config, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ss", "shadowsocks":
+	default:
+		return nil, fmt.Errorf("unsupported protocol '%s'", u.Scheme)
+	}
+	c := &Config{
+		Address: u.Host,
+		Tag:     u.Fragment,
+	}
+	if u.Port() == "" {
+		c.Address = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	if u.User != nil {
+		c.Cipher, c.Password, err = GetCipherAndPasswordFromUserinfo(u.User)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plugin := u.Query().Get("plugin"); plugin != "" {
+		p := strings.SplitN(plugin, ";", 2)
+		c.Plugin = p[0]
+		if len(p) == 2 {
+			c.PluginOptions = p[1]
+		}
+	}
+	return c, nil
+}
+
+// URL returns the SIP002 URI of the config, the userinfo is base64url encoded
+// except for the 2022 ciphers whose password is percent-encoded.
+func (c *Config) URL() *url.URL {
+	u := &url.URL{
+		Scheme:   "ss",
+		Host:     c.Address,
+		Fragment: c.Tag,
+	}
+	if strings.HasPrefix(strings.ToLower(c.Cipher), "2022-") {
+		u.User = url.UserPassword(c.Cipher, c.Password)
+	} else {
+		u.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(c.Cipher + ":" + c.Password)))
+	}
+	if c.Plugin != "" {
+		plugin := c.Plugin
+		if c.PluginOptions != "" {
+			plugin += ";" + c.PluginOptions
+		}
+		u.Path = "/"
+		u.RawQuery = url.Values{"plugin": {plugin}}.Encode()
+	}
+	return u
+}
+
+// String returns the SIP002 URI of the config
+func (c *Config) String() string {
+	return c.URL().String()
+}
+
+// NewCipher creates the cipher of the config
+func (c *Config) NewCipher() (ConnCipher, error) {
+	return NewCipher(c.Cipher, c.Password)
+}
+
+// parseEndpoint parses the URL of a server and creates its cipher,
+// it is shared by the constructors of the clients and the servers.
+func parseEndpoint(addr string) (*Config, ConnCipher, error) {
+	c, err := ParseURL(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	cipher, err := c.NewCipher()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, cipher, nil
+}
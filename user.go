@@ -0,0 +1,202 @@
+package shadowsocks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	errNoUser              = errors.New("no user matched")
+	errUnauthenticatedUser = errors.New("a cipher without authentication can't be told apart from the other users")
+)
+
+// User is a user of a multi-user server
+type User struct {
+	// Name identifies the user in logs and accounting
+	Name string
+	// Cipher use cipher protocol
+	Cipher string
+	// Password use password authentication
+	Password string
+	// ConnCipher is connect the cipher codec
+	ConnCipher ConnCipher
+}
+
+// NewUser creates a new User
+func NewUser(name, cipher, password string) (*User, error) {
+	c, err := NewCipher(cipher, password)
+	if err != nil {
+		return nil, err
+	}
+	return &User{
+		Name:       name,
+		Cipher:     cipher,
+		Password:   password,
+		ConnCipher: c,
+	}, nil
+}
+
+// UserCipher is implemented by the ciphers that identify the user by themselves,
+// such as the SIP022 ciphers with identity headers.
+type UserCipher interface {
+	// StreamConnUser reads the header of conn and returns the decrypting conn of the user it belongs to
+	StreamConnUser(conn net.Conn, users []*User) (net.Conn, *User, error)
+	// OpenPacketUser decrypts a client packet and returns the server session of the user it belongs to
+	OpenPacketUser(dist, src []byte, users []*User) (n int, sess PacketSession, user *User, err error)
+}
+
+type userKey struct{}
+
+// ContextWithUser returns a context carrying the user
+func ContextWithUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFromContext returns the user matched for the connection, if any
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userKey{}).(*User)
+	return user, ok
+}
+
+// userError adds the user name to the error
+func userError(user *User, err error) error {
+	if err == nil || user == nil {
+		return err
+	}
+	return fmt.Errorf("user %s: %w", user.Name, err)
+}
+
+// checkUsers rejects the user tables of several users where some cipher is not authenticated,
+// such as a stream cipher, any data decrypts with it so its user would match every connection.
+func checkUsers(users []*User) error {
+	if len(users) < 2 {
+		return nil
+	}
+	for _, user := range users {
+		c, ok := user.ConnCipher.(AuthenticatedCipher)
+		if !ok || !c.Authenticated() {
+			return userError(user, errUnauthenticatedUser)
+		}
+	}
+	return nil
+}
+
+// matchUser identifies the user of the conn and returns the decrypting conn,
+// users are tried in order by decrypting the first chunk, so several users must use AEAD ciphers.
+func matchUser(conn net.Conn, c ConnCipher, users []*User) (net.Conn, *User, error) {
+	err := checkUsers(users)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uc, ok := c.(UserCipher); ok {
+		return uc.StreamConnUser(conn, users)
+	}
+	pc := &peekConn{Conn: conn, record: true}
+	var b [1]byte
+	for _, user := range users {
+		pc.rewind()
+		trial := user.ConnCipher.StreamConn(pc)
+		n, err := trial.Read(b[:])
+		if pc.err != nil {
+			return nil, nil, pc.err
+		}
+		if err == nil {
+			// the trial conn goes on from where it stopped, the salt is checked only once
+			pc.release()
+			return &prefixConn{Conn: trial, prefix: b[:n]}, user, nil
+		}
+	}
+	return nil, nil, errNoUser
+}
+
+// matchPacketUser identifies the user of the client packet and decrypts it
+func matchPacketUser(dist, src []byte, c ConnCipher, users []*User) (n int, addr net.Addr, sess PacketSession, user *User, err error) {
+	err = checkUsers(users)
+	if err != nil {
+		return 0, nil, nil, nil, err
+	}
+	if uc, ok := c.(UserCipher); ok {
+		n, sess, user, err = uc.OpenPacketUser(dist, src, users)
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		n, addr, err = splitPacketAddress(dist[:n])
+		if err != nil {
+			return 0, nil, nil, nil, err
+		}
+		return n, addr, sess, user, nil
+	}
+	for _, user := range users {
+		if pc, ok := user.ConnCipher.(PacketCipher); ok {
+			n, sess, err = pc.OpenPacket(dist, src)
+		} else {
+			sess = user.ConnCipher
+			n, err = sess.Decrypt(dist, src)
+		}
+		if err != nil {
+			continue
+		}
+		n, addr, err = splitPacketAddress(dist[:n])
+		if err != nil {
+			continue
+		}
+		return n, addr, sess, user, nil
+	}
+	return 0, nil, nil, nil, errNoUser
+}
+
+// peekConn records what is read from the conn, so it can be read again from the beginning
+type peekConn struct {
+	net.Conn
+	buf    []byte
+	off    int
+	record bool
+	// err is the last error of the underlying conn
+	err error
+}
+
+// rewind starts reading again from the beginning
+func (c *peekConn) rewind() {
+	c.off = 0
+}
+
+// release stops recording, what is left in the record is still read first
+func (c *peekConn) release() {
+	c.buf = c.buf[c.off:]
+	c.off = 0
+	c.record = false
+}
+
+func (c *peekConn) Read(b []byte) (int, error) {
+	if c.off < len(c.buf) {
+		n := copy(b, c.buf[c.off:])
+		c.off += n
+		return n, nil
+	}
+	n, err := c.Conn.Read(b)
+	if c.record {
+		c.buf = append(c.buf, b[:n]...)
+		c.off += n
+	}
+	if err != nil {
+		c.err = err
+	}
+	return n, err
+}
+
+// prefixConn reads the prefix before the conn
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}